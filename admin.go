@@ -0,0 +1,336 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+const (
+	adminKeysEndpoint = "/keys"
+
+	// Grace period of keys retired through the admin API when neither the
+	// request nor the rotation settings provide one
+	defaultAdminGracePeriod = time.Hour
+)
+
+// auditLog records every admin action, one JSON object per line, and mirrors
+// it to telemetry.
+type auditLog struct {
+	sync.Mutex
+	writer             io.Writer
+	telemetryClient    *telemetry
+	serverInstanceName string
+	experimentId       string
+}
+
+func (a *auditLog) record(event auditEvent) {
+	event.Timestamp = time.Now().UnixNano()
+	event.IngestedFrom = a.serverInstanceName
+	event.ExperimentID = a.experimentId
+	line := event.serialize()
+
+	a.Lock()
+	if _, err := fmt.Fprintln(a.writer, line); err != nil {
+		log.Printf("Failed to write audit record %s: %v", line, err)
+	}
+	a.Unlock()
+
+	if a.telemetryClient != nil {
+		a.telemetryClient.stream([]string{line})
+	}
+}
+
+// adminServer manages the target keys on a listener separate from the public
+// endpoints. When a token is set, requests must carry it as a bearer token;
+// otherwise they must present a client certificate verified against the
+// admin client CA. Both may be required at once.
+type adminServer struct {
+	keys        *targetKeySet
+	suites      []cipherSuite
+	generate    func(suite cipherSuite) (odoh.ObliviousDoHKeyPair, error)
+	gracePeriod time.Duration
+	token       string
+	audit       *auditLog
+}
+
+func (s *adminServer) authenticate(r *http.Request) bool {
+	if s.token != "" {
+		const prefix = "Bearer "
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, prefix) {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(authorization[len(prefix):]), []byte(s.token)) == 1
+	}
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+func actorOf(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.String()
+	}
+	if r.Header.Get("Authorization") != "" {
+		return "token"
+	}
+	return "anonymous"
+}
+
+func (s *adminServer) recordAction(r *http.Request, action string, keyID string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = err.Error()
+	}
+	s.audit.record(auditEvent{
+		Action:     action,
+		KeyID:      keyID,
+		Actor:      actorOf(r),
+		RemoteAddr: r.RemoteAddr,
+		Outcome:    outcome,
+	})
+}
+
+func (s *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminKeysEndpoint, s.keysHandler)
+	mux.HandleFunc(adminKeysEndpoint+"/", s.keyActionHandler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authenticate(r) {
+			s.recordAction(r, "authenticate", "", errors.New("denied"))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Failed to write admin response: %v", err)
+	}
+}
+
+func adminErrorStatus(err error) int {
+	switch err {
+	case errUnknownKey:
+		return http.StatusNotFound
+	case errInvalidKeyState, errLastActiveKey:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// keysHandler lists the keys on GET, and generates a pending key on POST. The
+// suite query parameter selects the cipher suite of the new key, defaulting to
+// the first configured suite.
+func (s *adminServer) keysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.recordAction(r, "list", "", nil)
+		writeJSON(w, http.StatusOK, s.keys.describe())
+	case http.MethodPost:
+		suite := defaultCipherSuite
+		if len(s.suites) > 0 {
+			suite = s.suites[0]
+		}
+		if name := r.URL.Query().Get("suite"); name != "" {
+			var err error
+			if suite, err = parseCipherSuite(name); err != nil {
+				s.recordAction(r, "generate", "", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		keyPair, err := s.generate(suite)
+		if err != nil {
+			s.recordAction(r, "generate", "", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		keyID := keyPair.Config.Contents.KeyID()
+		s.keys.set(keyPair, keyStatePending, time.Now(), time.Time{})
+		s.recordAction(r, "generate", hex.EncodeToString(keyID), nil)
+		log.Printf("Generated pending ODoH key %x (%v) through the admin API", keyID, suite)
+
+		for _, info := range s.keys.describe() {
+			if info.KeyID == hex.EncodeToString(keyID) {
+				writeJSON(w, http.StatusCreated, info)
+				return
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// keyActionHandler applies POST /keys/<key ID>/<action>, where action is
+// promote, retire or revoke. Promoted and retired keys stay accepted for the
+// duration given by the grace query parameter, or the configured grace period.
+// It responds with the resulting key list.
+func (s *adminServer) keyActionHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminKeysEndpoint+"/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	keyIDHex, action := parts[0], parts[1]
+
+	keyID, err := hex.DecodeString(keyIDHex)
+	if err != nil {
+		s.recordAction(r, action, keyIDHex, err)
+		http.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+
+	gracePeriod := s.gracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultAdminGracePeriod
+	}
+	if setting := r.URL.Query().Get("grace"); setting != "" {
+		if gracePeriod, err = time.ParseDuration(setting); err != nil || gracePeriod < 0 {
+			s.recordAction(r, action, keyIDHex, fmt.Errorf("invalid grace period %q", setting))
+			http.Error(w, "Invalid grace period", http.StatusBadRequest)
+			return
+		}
+	}
+	retireAt := time.Now().Add(gracePeriod)
+
+	var replacement []byte
+	switch action {
+	case "promote":
+		var retiring [][]byte
+		if retiring, err = s.keys.promote(keyID, retireAt); err == nil {
+			log.Printf("Promoted ODoH key %x through the admin API", keyID)
+			for _, retiringKeyID := range retiring {
+				log.Printf("Retiring ODoH key %x at %v", retiringKeyID, retireAt)
+			}
+		}
+	case "retire":
+		if err = s.keys.retire(keyID, retireAt); err == nil {
+			log.Printf("Retiring ODoH key %x at %v through the admin API", keyID, retireAt)
+		}
+	case "revoke":
+		if replacement, err = s.keys.revoke(keyID, s.generate); err == nil {
+			log.Printf("Revoked ODoH key %x through the admin API", keyID)
+			if replacement != nil {
+				log.Printf("Activated ODoH key %x in place of the revoked key", replacement)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	s.recordAction(r, action, hex.EncodeToString(keyID), err)
+	if replacement != nil {
+		s.recordAction(r, "replace", hex.EncodeToString(replacement), nil)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.keys.describe())
+}
+
+// adminTLSConfig requires and verifies client certificates when clientCAs is
+// set.
+func adminTLSConfig(clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(encoded) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// serve listens for admin requests on address. TLS is enabled when certFile
+// and keyFile are set, and client certificates are required when clientCAFile
+// is set.
+func (s *adminServer) serve(address string, certFile string, keyFile string, clientCAFile string) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: s.handler(),
+	}
+
+	if clientCAFile == "" {
+		if s.token == "" {
+			return errors.New("the admin API requires a token or a client CA")
+		}
+	} else {
+		if certFile == "" || keyFile == "" {
+			return errors.New("client certificate authentication requires TLS")
+		}
+		clientCAs, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = adminTLSConfig(clientCAs)
+	}
+
+	if certFile != "" && keyFile != "" {
+		if server.TLSConfig == nil {
+			server.TLSConfig = adminTLSConfig(nil)
+		}
+		log.Printf("Admin API listening on %v with TLS", address)
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	log.Printf("Admin API listening on %v without TLS; the token is sent in the clear", address)
+	return server.ListenAndServe()
+}
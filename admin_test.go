@@ -0,0 +1,318 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-secret"
+
+func createAdminServer(keys *targetKeySet) (*adminServer, *bytes.Buffer) {
+	audit := &bytes.Buffer{}
+	return &adminServer{
+		keys:        keys,
+		generate:    cipherSuite.generateKeyPair,
+		gracePeriod: 10 * time.Minute,
+		token:       testAdminToken,
+		audit:       &auditLog{writer: audit},
+	}, audit
+}
+
+func sendAdminRequest(t *testing.T, admin *adminServer, method string, path string, token string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	admin.handler().ServeHTTP(rr, request)
+	return rr
+}
+
+func decodeKeyInfos(t *testing.T, rr *httptest.ResponseRecorder) map[string]string {
+	var infos []keyInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]string)
+	for _, info := range infos {
+		states[info.KeyID] = info.State
+	}
+	return states
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	admin, audit := createAdminServer(newTargetKeySet(createKeyPair(t)))
+
+	for _, token := range []string{"", "wrong"} {
+		if rr := sendAdminRequest(t, admin, http.MethodGet, adminKeysEndpoint, token); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Request with token %q yielded %d, expected %d", token, rr.Code, http.StatusUnauthorized)
+		}
+	}
+	if rr := sendAdminRequest(t, admin, http.MethodGet, adminKeysEndpoint, testAdminToken); rr.Code != http.StatusOK {
+		t.Fatalf("Authenticated request yielded %d", rr.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 audit records, got %d", len(lines))
+	}
+	var event auditEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Action != "authenticate" || event.Outcome != "denied" {
+		t.Fatalf("Unexpected audit record for a rejected request: %s", lines[0])
+	}
+}
+
+func TestAdminKeyLifecycle(t *testing.T) {
+	store, cleanup := createKeyStore(t)
+	defer cleanup()
+
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	target.odohKeys.store = store
+	admin, audit := createAdminServer(target.odohKeys)
+	oldConfig := target.odohKeys.configs().Configs[0]
+	oldKeyID := hex.EncodeToString(oldConfig.Contents.KeyID())
+	q := []byte(r.queries[0])
+
+	rr := sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"?suite=P256-SHA256-AES128GCM", testAdminToken)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Key generation failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	var generated keyInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &generated); err != nil {
+		t.Fatal(err)
+	}
+	if generated.State != "pending" || generated.Suite != "P256-SHA256-AES128GCM" {
+		t.Fatalf("Unexpected generated key %+v", generated)
+	}
+	newKeyID, _ := hex.DecodeString(generated.KeyID)
+	newKeyPair, ok := target.odohKeys.keyPairForID(newKeyID)
+	if !ok {
+		t.Fatal("Generated key is not held by the target")
+	}
+	if len(target.odohKeys.configs().Configs) != 1 {
+		t.Fatal("Pending key is advertised")
+	}
+	if status := sendObliviousQuery(t, &target, newKeyPair.Config, q); status != http.StatusOK {
+		t.Fatalf("Query to pending key failed with %d", status)
+	}
+
+	// Promoting a key of another suite leaves the existing key active.
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+generated.KeyID+"/promote", testAdminToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Promotion failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if states := decodeKeyInfos(t, rr); states[generated.KeyID] != "active" || states[oldKeyID] != "active" {
+		t.Fatalf("Unexpected key states after promotion: %v", states)
+	}
+
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+oldKeyID+"/retire?grace=1h", testAdminToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Retirement failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if states := decodeKeyInfos(t, rr); states[oldKeyID] != "retiring" {
+		t.Fatalf("Unexpected key states after retirement: %v", states)
+	}
+	if status := sendObliviousQuery(t, &target, oldConfig, q); status != http.StatusOK {
+		t.Fatalf("Query to retiring key failed with %d", status)
+	}
+
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+generated.KeyID+"/retire", testAdminToken)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("Retiring the last active key yielded %d, expected %d", rr.Code, http.StatusConflict)
+	}
+
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+oldKeyID+"/revoke", testAdminToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Revocation failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if states := decodeKeyInfos(t, rr); len(states) != 1 {
+		t.Fatalf("Revoked key is still held: %v", states)
+	}
+	if status := sendObliviousQuery(t, &target, oldConfig, q); status != http.StatusUnauthorized {
+		t.Fatalf("Query to revoked key yielded %d, expected %d", status, http.StatusUnauthorized)
+	}
+
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+oldKeyID+"/revoke", testAdminToken)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Revoking an unknown key yielded %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+	// Revoking the last active key puts a new one in its place.
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+generated.KeyID+"/revoke", testAdminToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Revoking the last active key failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	states := decodeKeyInfos(t, rr)
+	if len(states) != 1 || states[generated.KeyID] != "" {
+		t.Fatalf("Unexpected key states after revoking the last active key: %v", states)
+	}
+	configs := target.odohKeys.configs().Configs
+	if len(configs) != 1 || hex.EncodeToString(configs[0].Contents.KeyID()) == generated.KeyID {
+		t.Fatal("No replacement key is advertised")
+	}
+	if cipherSuiteOf(configs[0].Contents).String() != generated.Suite {
+		t.Fatalf("Replacement key has suite %v instead of %s", cipherSuiteOf(configs[0].Contents), generated.Suite)
+	}
+	if status := sendObliviousQuery(t, &target, newKeyPair.Config, q); status != http.StatusUnauthorized {
+		t.Fatalf("Query to revoked key yielded %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := sendObliviousQuery(t, &target, configs[0], q); status != http.StatusOK {
+		t.Fatalf("Query to replacement key failed with %d", status)
+	}
+
+	storedKeys, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedKeys) != 1 || !bytes.Equal(storedKeys[0].keyID, configs[0].Contents.KeyID()) {
+		t.Fatal("Keystore does not reflect the revocations")
+	}
+
+	if records := strings.Count(audit.String(), "\n"); records != 8 {
+		t.Fatalf("Expected 8 audit records, got %d", records)
+	}
+	if !strings.Contains(audit.String(), `"replace"`) {
+		t.Fatal("Audit log does not record the replacement key")
+	}
+}
+
+func TestAdminRetiredKeyExpiresWithoutRotation(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	admin, _ := createAdminServer(target.odohKeys)
+	oldConfig := target.odohKeys.configs().Configs[0]
+	q := []byte(r.queries[0])
+
+	rr := sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint, testAdminToken)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Key generation failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	var generated keyInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &generated); err != nil {
+		t.Fatal(err)
+	}
+	rr = sendAdminRequest(t, admin, http.MethodPost, adminKeysEndpoint+"/"+generated.KeyID+"/promote?grace=50ms", testAdminToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Promotion failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if status := sendObliviousQuery(t, &target, oldConfig, q); status != http.StatusOK {
+		t.Fatalf("Query to retiring key failed with %d", status)
+	}
+
+	// No rotator runs to expire the key: it must be refused all the same.
+	time.Sleep(100 * time.Millisecond)
+	if status := sendObliviousQuery(t, &target, oldConfig, q); status != http.StatusUnauthorized {
+		t.Fatalf("Query to key past its grace period yielded %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+func createCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	encoded, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func TestAdminClientCertificate(t *testing.T) {
+	admin, audit := createAdminServer(newTargetKeySet(createKeyPair(t)))
+	admin.token = ""
+
+	now := time.Now()
+	caCertificate, caKey := createCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "admin CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	clientCertificate, clientKey := createCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "operator"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCertificate, caKey)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCertificate)
+	server := httptest.NewUnstartedServer(admin.handler())
+	server.TLS = adminTLSConfig(clientCAs)
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	if _, err := client.Get(server.URL + adminKeysEndpoint); err == nil {
+		t.Fatal("Request without a client certificate succeeded")
+	}
+
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{clientCertificate.Raw},
+		PrivateKey:  clientKey,
+	}}
+	response, err := client.Get(server.URL + adminKeysEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Request with a client certificate yielded %d", response.StatusCode)
+	}
+	if !strings.Contains(audit.String(), "CN=operator") {
+		t.Fatalf("Audit log does not name the client: %s", audit.String())
+	}
+}
@@ -0,0 +1,345 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	cacheShards = 32
+
+	defaultCacheSize   = 10000
+	defaultCacheMaxTTL = 24 * time.Hour
+
+	// RFC 2308 recommends caching negative answers for at most one to three
+	// hours.
+	maxNegativeTTL = 3 * time.Hour
+)
+
+// cacheKey identifies the answers the cache holds. Queries with the DNSSEC OK
+// bit set are answered separately, as their answers carry signatures.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+}
+
+func newCacheKey(query *dns.Msg) (cacheKey, bool) {
+	if len(query.Question) != 1 {
+		return cacheKey{}, false
+	}
+	question := query.Question[0]
+	do := false
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return cacheKey{
+		name:   strings.ToLower(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+		do:     do,
+	}, true
+}
+
+// cacheEntry is an answer held by the cache. Hits and prefetching are guarded
+// by the shard lock.
+type cacheEntry struct {
+	key         cacheKey
+	response    *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+// cacheShard holds a share of the entries, and evicts the least recently used
+// one when full.
+type cacheShard struct {
+	sync.Mutex
+	entries  map[cacheKey]*list.Element
+	recency  *list.List
+	capacity int
+}
+
+// answerCache holds upstream answers until their TTL expires, or for the stale
+// window after that. It is split in shards locked separately, each bounded to
+// a share of the total size.
+type answerCache struct {
+	hits              uint64
+	misses            uint64
+	staleHits         uint64
+	evictions         uint64
+	prefetches        uint64
+	prefetchFailures  uint64
+	prefetchesLimited uint64
+
+	shards []*cacheShard
+	minTTL time.Duration
+	maxTTL time.Duration
+
+	// How long expired answers are kept to be served stale, and how long a
+	// query waits for a fresh answer before a stale one is served instead
+	staleWindow   time.Duration
+	staleDeadline time.Duration
+
+	// Refreshes popular answers before they expire, if set
+	prefetch        func(query *dns.Msg) error
+	prefetchLimiter *tokenBucket
+	prefetchMinHits int
+
+	telemetryClient    *telemetry
+	serverInstanceName string
+	experimentId       string
+}
+
+func newAnswerCache(size int, minTTL time.Duration, maxTTL time.Duration) *answerCache {
+	capacity := (size + cacheShards - 1) / cacheShards
+	if capacity < 1 {
+		capacity = 1
+	}
+	shards := make([]*cacheShard, cacheShards)
+	for i := range shards {
+		shards[i] = &cacheShard{
+			entries:  make(map[cacheKey]*list.Element),
+			recency:  list.New(),
+			capacity: capacity,
+		}
+	}
+	return &answerCache{
+		shards: shards,
+		minTTL: minTTL,
+		maxTTL: maxTTL,
+	}
+}
+
+func (c *answerCache) shard(key cacheKey) *cacheShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key.name))
+	return c.shards[(hash.Sum32()^uint32(key.qtype))%cacheShards]
+}
+
+func (c *answerCache) clamp(ttl time.Duration) time.Duration {
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	return ttl
+}
+
+// records calls f with every record of message except the OPT record.
+func records(message *dns.Msg, f func(rr dns.RR)) {
+	for _, section := range [][]dns.RR{message.Answer, message.Ns, message.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				f(rr)
+			}
+		}
+	}
+}
+
+// negativeTTL returns how long a negative answer may be cached according to
+// RFC 2308: the lower of the TTL and the MINIMUM field of the SOA record in
+// the authority section, and at most maxNegativeTTL. Negative answers without
+// one are not cached.
+func negativeTTL(response *dns.Msg) (*dns.SOA, time.Duration, bool) {
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(soa.Hdr.Ttl) * time.Second
+			if minimum := time.Duration(soa.Minttl) * time.Second; minimum < ttl {
+				ttl = minimum
+			}
+			if ttl > maxNegativeTTL {
+				ttl = maxNegativeTTL
+			}
+			return soa, ttl, true
+		}
+	}
+	return nil, 0, false
+}
+
+// cacheTTL returns how long response may be cached: the lowest TTL of its
+// records, or the negative caching TTL for NXDOMAIN and NODATA answers.
+func cacheTTL(response *dns.Msg) (time.Duration, bool) {
+	if response.Truncated || (response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	ttl := time.Duration(-1)
+	if isNegative(response) {
+		_, negative, ok := negativeTTL(response)
+		if !ok {
+			return 0, false
+		}
+		ttl = negative
+	}
+	records(response, func(rr dns.RR) {
+		if recordTTL := time.Duration(rr.Header().Ttl) * time.Second; ttl < 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	})
+	return ttl, ttl >= 0
+}
+
+// isNegative reports whether response is an NXDOMAIN or NODATA answer.
+func isNegative(response *dns.Msg) bool {
+	return response.Rcode == dns.RcodeNameError || len(response.Answer) == 0
+}
+
+// set stores the response to query, unless it cannot be cached or its TTL is
+// zero. Record TTLs are clamped like the entry's lifetime, so that they stay
+// positive until it expires.
+func (c *answerCache) set(query *dns.Msg, response *dns.Msg, now time.Time) {
+	key, ok := newCacheKey(query)
+	if !ok || !matchesQuestion(query, response) {
+		return
+	}
+	ttl, ok := cacheTTL(response)
+	if !ok {
+		return
+	}
+	if ttl = c.clamp(ttl); ttl < time.Second {
+		return
+	}
+
+	stored := response.Copy()
+	removeOPT(stored)
+	if soa, negative, ok := negativeTTL(stored); ok && isNegative(stored) {
+		soa.Hdr.Ttl = uint32(negative / time.Second)
+	}
+	records(stored, func(rr dns.RR) {
+		rr.Header().Ttl = uint32(c.clamp(time.Duration(rr.Header().Ttl)*time.Second) / time.Second)
+	})
+	c.insert(&cacheEntry{key: key, response: stored, stored: now, expires: now.Add(ttl)})
+}
+
+func (c *answerCache) insert(entry *cacheEntry) {
+	shard := c.shard(entry.key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if element, ok := shard.entries[entry.key]; ok {
+		element.Value = entry
+		shard.recency.MoveToFront(element)
+		return
+	}
+	shard.entries[entry.key] = shard.recency.PushFront(entry)
+	for shard.recency.Len() > shard.capacity {
+		oldest := shard.recency.Back()
+		shard.recency.Remove(oldest)
+		delete(shard.entries, oldest.Value.(*cacheEntry).key)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// lookup returns the entry for key, whether or not it expired.
+func (c *answerCache) lookup(key cacheKey) (*cacheEntry, bool) {
+	shard := c.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	element, ok := shard.entries[key]
+	if !ok {
+		return nil, false
+	}
+	shard.recency.MoveToFront(element)
+	return element.Value.(*cacheEntry), true
+}
+
+// answer builds the response to query from entry, with record TTLs reduced by
+// the time spent in the cache.
+func (entry *cacheEntry) answer(query *dns.Msg, now time.Time) *dns.Msg {
+	response := replyCopy(query, entry.response)
+	elapsed := uint32(0)
+	if age := now.Sub(entry.stored); age > 0 {
+		elapsed = uint32(age / time.Second)
+	}
+	records(response, func(rr dns.RR) {
+		if rr.Header().Ttl > elapsed {
+			rr.Header().Ttl -= elapsed
+		} else {
+			rr.Header().Ttl = 0
+		}
+	})
+	return response
+}
+
+// get returns the cached response to query, or nil if there is none or it
+// expired.
+func (c *answerCache) get(query *dns.Msg, now time.Time) *dns.Msg {
+	key, ok := newCacheKey(query)
+	if !ok {
+		return nil
+	}
+	entry, ok := c.lookup(key)
+	if !ok || !now.Before(entry.expires) {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.hits, 1)
+	if c.prefetch != nil && c.claimPrefetch(entry, now) {
+		go c.runPrefetch(entry)
+	}
+	return entry.answer(query, now)
+}
+
+func (c *answerCache) size() int {
+	entries := 0
+	for _, shard := range c.shards {
+		shard.Lock()
+		entries += shard.recency.Len()
+		shard.Unlock()
+	}
+	return entries
+}
+
+func (c *answerCache) report(now time.Time) {
+	if c.telemetryClient == nil {
+		return
+	}
+	e := cacheEvent{
+		Event:             "answer_cache",
+		Hits:              atomic.LoadUint64(&c.hits),
+		Misses:            atomic.LoadUint64(&c.misses),
+		StaleHits:         atomic.LoadUint64(&c.staleHits),
+		Prefetches:        atomic.LoadUint64(&c.prefetches),
+		PrefetchFailures:  atomic.LoadUint64(&c.prefetchFailures),
+		PrefetchesLimited: atomic.LoadUint64(&c.prefetchesLimited),
+		Evictions:         atomic.LoadUint64(&c.evictions),
+		Entries:           c.size(),
+		Timestamp:         now.UnixNano(),
+		IngestedFrom:      c.serverInstanceName,
+		ExperimentID:      c.experimentId,
+	}
+	c.telemetryClient.stream([]string{e.serialize()})
+}
@@ -0,0 +1,234 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingResolver answers every A query with 192.0.2.1 after an optional
+// delay, and counts queries.
+type countingResolver struct {
+	calls int32
+	delay time.Duration
+}
+
+func (r *countingResolver) name() string {
+	return "counting"
+}
+
+func (r *countingResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&r.calls, 1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return answerA(query, "192.0.2.1"), nil
+}
+
+func negativeAnswer(query *dns.Msg, rcode int, ttl uint32, minimum uint32) *dns.Msg {
+	response := &dns.Msg{}
+	response.SetRcode(query, rcode)
+	response.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: minimum,
+	}}
+	return response
+}
+
+func TestCacheDecrementsTTL(t *testing.T) {
+	cache := newAnswerCache(100, 0, time.Hour)
+	now := time.Now()
+	query := questionFor("Example.COM.")
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+
+	later := questionFor("example.com.")
+	later.Id = query.Id + 1
+	response := cache.get(later, now.Add(45*time.Second))
+	if response == nil {
+		t.Fatal("Cached answer not found")
+	}
+	if response.Id != later.Id || response.Question[0].Name != "example.com." {
+		t.Fatalf("Answer does not match the query: %v", response)
+	}
+	if ttl := response.Answer[0].Header().Ttl; ttl != 15 {
+		t.Fatalf("Cached answer has TTL %d, expected 15", ttl)
+	}
+
+	if cache.get(later, now.Add(60*time.Second)) != nil {
+		t.Fatal("Expired answer served")
+	}
+	if cache.hits != 1 || cache.misses != 1 {
+		t.Fatalf("Counted %d hits and %d misses", cache.hits, cache.misses)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	cache := newAnswerCache(100, 0, time.Hour)
+	now := time.Now()
+	query := questionFor("example.com.")
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+
+	other := &dns.Msg{}
+	other.SetQuestion("example.com.", dns.TypeAAAA)
+	if cache.get(other, now) != nil {
+		t.Fatal("Answer served for another type")
+	}
+	signed := questionFor("example.com.")
+	signed.SetEdns0(1232, true)
+	if cache.get(signed, now) != nil {
+		t.Fatal("Answer served to a query with the DNSSEC OK bit")
+	}
+
+	// The OPT record follows the query, not the cached response.
+	edns := questionFor("example.com.")
+	edns.SetEdns0(4096, false)
+	if response := cache.get(edns, now); response == nil || response.IsEdns0() == nil {
+		t.Fatal("Answer to an EDNS query lacks an OPT record")
+	}
+	ednsResponse := answerA(edns, "192.0.2.1")
+	ednsResponse.SetEdns0(1232, false)
+	cache.set(edns, ednsResponse, now)
+	if response := cache.get(query, now); response == nil || response.IsEdns0() != nil {
+		t.Fatal("Answer to a query without EDNS has an OPT record")
+	}
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	cache := newAnswerCache(100, 0, time.Hour)
+	now := time.Now()
+
+	nxdomain := questionFor("missing.example.")
+	cache.set(nxdomain, negativeAnswer(nxdomain, dns.RcodeNameError, 3600, 30), now)
+	response := cache.get(nxdomain, now.Add(10*time.Second))
+	if response == nil || response.Rcode != dns.RcodeNameError {
+		t.Fatal("NXDOMAIN answer not cached")
+	}
+	if ttl := response.Ns[0].Header().Ttl; ttl != 20 {
+		t.Fatalf("SOA record has TTL %d, expected 20", ttl)
+	}
+	if cache.get(nxdomain, now.Add(30*time.Second)) != nil {
+		t.Fatal("NXDOMAIN answer cached beyond the SOA minimum")
+	}
+
+	nodata := questionFor("nodata.example.")
+	cache.set(nodata, negativeAnswer(nodata, dns.RcodeSuccess, 20, 600), now)
+	if cache.get(nodata, now.Add(10*time.Second)) == nil {
+		t.Fatal("NODATA answer not cached")
+	}
+	if cache.get(nodata, now.Add(20*time.Second)) != nil {
+		t.Fatal("NODATA answer cached beyond the SOA TTL")
+	}
+
+	withoutSOA := questionFor("nosoa.example.")
+	response = &dns.Msg{}
+	response.SetRcode(withoutSOA, dns.RcodeNameError)
+	cache.set(withoutSOA, response, now)
+	failure := questionFor("failure.example.")
+	response = &dns.Msg{}
+	response.SetRcode(failure, dns.RcodeServerFailure)
+	cache.set(failure, response, now)
+	if cache.size() != 2 {
+		t.Fatalf("Cache holds %d answers, expected 2", cache.size())
+	}
+}
+
+func TestCacheClampsTTL(t *testing.T) {
+	cache := newAnswerCache(100, 90*time.Second, 2*time.Minute)
+	now := time.Now()
+
+	short := questionFor("short.example.")
+	cache.set(short, answerA(short, "192.0.2.1"), now)
+	response := cache.get(short, now.Add(80*time.Second))
+	if response == nil || response.Answer[0].Header().Ttl != 10 {
+		t.Fatalf("Unexpected answer below the minimum TTL: %v", response)
+	}
+
+	long := questionFor("long.example.")
+	answer := answerA(long, "192.0.2.1")
+	answer.Answer[0].Header().Ttl = 86400
+	cache.set(long, answer, now)
+	if response := cache.get(long, now); response == nil || response.Answer[0].Header().Ttl != 120 {
+		t.Fatalf("Unexpected answer above the maximum TTL: %v", response)
+	}
+	if cache.get(long, now.Add(2*time.Minute)) != nil {
+		t.Fatal("Answer cached beyond the maximum TTL")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newAnswerCache(cacheShards, 0, time.Hour)
+	now := time.Now()
+	for i := 0; i < 10*cacheShards; i++ {
+		query := questionFor(dns.Fqdn(string(rune('a'+i%26)) + string(rune('a'+i/26)) + ".example"))
+		cache.set(query, answerA(query, "192.0.2.1"), now)
+	}
+	if size := cache.size(); size > cacheShards {
+		t.Fatalf("Cache holds %d answers, more than %d", size, cacheShards)
+	}
+	if cache.evictions < 9*cacheShards {
+		t.Fatalf("Only %d answers evicted", cache.evictions)
+	}
+}
+
+func TestTargetServesCachedAnswers(t *testing.T) {
+	r := &countingResolver{}
+	target := createTarget(t, r)
+	target.cache = newAnswerCache(100, 0, time.Hour)
+
+	query := questionFor("example.com.")
+	packedQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(packedQuery))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", dnsMessageContentType)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(target.targetQueryHandler).ServeHTTP(rr, request)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Query yielded %d", rr.Code)
+		}
+		response := &dns.Msg{}
+		if err := response.Unpack(rr.Body.Bytes()); err != nil || len(response.Answer) != 1 {
+			t.Fatalf("Unexpected response %v: %v", response, err)
+		}
+	}
+	if calls := atomic.LoadInt32(&r.calls); calls != 1 {
+		t.Fatalf("Upstream queried %d times", calls)
+	}
+}
@@ -0,0 +1,149 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	cacheFileVersion = 1
+
+	// Cached answers reveal what clients asked for, so the file is private.
+	cacheFileMode = 0600
+)
+
+type cacheFile struct {
+	Version int               `json:"version"`
+	Saved   time.Time         `json:"saved"`
+	Entries []cacheFileRecord `json:"entries"`
+}
+
+type cacheFileRecord struct {
+	Name     string    `json:"name"`
+	Qtype    uint16    `json:"qtype"`
+	Qclass   uint16    `json:"qclass"`
+	DO       bool      `json:"do"`
+	Response []byte    `json:"response"`
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+}
+
+// snapshot returns the answers that have not expired at now, from the least
+// to the most recently used in each shard.
+func (c *answerCache) snapshot(now time.Time) ([]cacheFileRecord, error) {
+	records := make([]cacheFileRecord, 0)
+	for _, shard := range c.shards {
+		shard.Lock()
+		for element := shard.recency.Back(); element != nil; element = element.Prev() {
+			entry := element.Value.(*cacheEntry)
+			if !now.Before(entry.expires) {
+				continue
+			}
+			packed, err := entry.response.Pack()
+			if err != nil {
+				shard.Unlock()
+				return nil, err
+			}
+			records = append(records, cacheFileRecord{
+				Name:     entry.key.name,
+				Qtype:    entry.key.qtype,
+				Qclass:   entry.key.qclass,
+				DO:       entry.key.do,
+				Response: packed,
+				Stored:   entry.stored,
+				Expires:  entry.expires,
+			})
+		}
+		shard.Unlock()
+	}
+	return records, nil
+}
+
+// save writes the answers that have not expired to the file at path.
+func (c *answerCache) save(path string, now time.Time) (int, error) {
+	records, err := c.snapshot(now)
+	if err != nil {
+		return 0, err
+	}
+	encoded, err := json.Marshal(cacheFile{
+		Version: cacheFileVersion,
+		Saved:   now.Round(0),
+		Entries: records,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(records), writeFileAtomically(path, encoded, cacheFileMode)
+}
+
+// load restores the answers saved to the file at path that have not expired
+// since. As entries keep the wall time at which they were stored, the TTLs of
+// restored answers account for the time spent on disk. A missing file is not
+// an error.
+func (c *answerCache) load(path string, now time.Time) (int, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return 0, err
+	}
+	if file.Version != cacheFileVersion {
+		return 0, fmt.Errorf("unsupported cache file version %d", file.Version)
+	}
+
+	restored := 0
+	for _, record := range file.Entries {
+		if !now.Before(record.Expires) {
+			continue
+		}
+		response := &dns.Msg{}
+		if err := response.Unpack(record.Response); err != nil {
+			return restored, err
+		}
+		c.insert(&cacheEntry{
+			key: cacheKey{
+				name:   record.Name,
+				qtype:  record.Qtype,
+				qclass: record.Qclass,
+				do:     record.DO,
+			},
+			response: response,
+			stored:   record.Stored,
+			expires:  record.Expires,
+		})
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,125 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func createCacheFileDir(t *testing.T) (string, func()) {
+	directory, err := ioutil.TempDir("", "odoh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory, func() { os.RemoveAll(directory) }
+}
+
+func TestCacheSaveAndLoad(t *testing.T) {
+	directory, cleanup := createCacheFileDir(t)
+	defer cleanup()
+	path := filepath.Join(directory, "cache.json")
+
+	cache := newAnswerCache(100, 0, time.Hour)
+	now := time.Now()
+	short := questionFor("short.example.")
+	cache.set(short, answerA(short, "192.0.2.1"), now)
+	long := questionFor("long.example.")
+	signed := questionFor("long.example.")
+	signed.SetEdns0(1232, true)
+	answer := answerA(signed, "192.0.2.2")
+	answer.Answer[0].Header().Ttl = 300
+	cache.set(signed, answer, now)
+	expired := questionFor("expired.example.")
+	cache.set(expired, answerA(expired, "192.0.2.3"), now.Add(-time.Hour))
+
+	saved, err := cache.save(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 2 {
+		t.Fatalf("Saved %d answers, expected 2", saved)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != cacheFileMode {
+		t.Fatalf("Cache file has mode %04o", info.Mode().Perm())
+	}
+
+	// Answers expired while the target was down are dropped, and the others
+	// have aged.
+	restarted := newAnswerCache(100, 0, time.Hour)
+	later := now.Add(100 * time.Second)
+	restored, err := restarted.load(path, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 || restarted.get(short, later) != nil {
+		t.Fatalf("Restored %d answers, expected 1", restored)
+	}
+	if restarted.get(long, later) != nil {
+		t.Fatal("Answer restored without its DNSSEC OK bit")
+	}
+	response := restarted.get(signed, later)
+	if response == nil {
+		t.Fatal("Answer not restored")
+	}
+	if ttl := response.Answer[0].Header().Ttl; ttl != 200 {
+		t.Fatalf("Restored answer has TTL %d, expected 200", ttl)
+	}
+	if response.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("Unexpected restored answer %v", response)
+	}
+}
+
+func TestCacheLoadMissingFile(t *testing.T) {
+	directory, cleanup := createCacheFileDir(t)
+	defer cleanup()
+
+	restored, err := newAnswerCache(100, 0, time.Hour).load(filepath.Join(directory, "missing.json"), time.Now())
+	if err != nil || restored != 0 {
+		t.Fatalf("Loading a missing file restored %d answers: %v", restored, err)
+	}
+}
+
+func TestCacheLoadRejectsInvalidFile(t *testing.T) {
+	directory, cleanup := createCacheFileDir(t)
+	defer cleanup()
+
+	for _, contents := range []string{`{"version": 2, "entries": []}`, `not json`} {
+		path := filepath.Join(directory, "cache.json")
+		if err := ioutil.WriteFile(path, []byte(contents), cacheFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newAnswerCache(100, 0, time.Hour).load(path, time.Now()); err == nil {
+			t.Fatalf("Loaded invalid file %q", contents)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// inflightExchange is an upstream exchange that identical queries wait for.
+type inflightExchange struct {
+	done   chan struct{}
+	result upstreamResolution
+}
+
+// queryCoalescer lets concurrent queries with the same cache key share one
+// upstream exchange.
+type queryCoalescer struct {
+	exchanges uint64
+	coalesced uint64
+
+	sync.Mutex
+	inflight map[cacheKey]*inflightExchange
+
+	telemetryClient    *telemetry
+	serverInstanceName string
+	experimentId       string
+}
+
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{
+		inflight: make(map[cacheKey]*inflightExchange),
+	}
+}
+
+// replyCopy returns a copy of response, shared by several queries, suited to
+// query: with its ID and question, and an OPT record only if it has one.
+func replyCopy(query *dns.Msg, response *dns.Msg) *dns.Msg {
+	reply := response.Copy()
+	reply.Id = query.Id
+	reply.Question = append([]dns.Question(nil), query.Question...)
+	if opt := query.IsEdns0(); opt == nil {
+		removeOPT(reply)
+	} else if reply.IsEdns0() == nil {
+		reply.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return reply
+}
+
+// do resolves query with exchange, unless an identical query is already being
+// resolved, in which case it waits for that result instead and marks it
+// coalesced.
+func (c *queryCoalescer) do(query *dns.Msg, exchange func(*dns.Msg) upstreamResolution) upstreamResolution {
+	key, ok := newCacheKey(query)
+	if !ok {
+		return exchange(query)
+	}
+
+	c.Lock()
+	if call, ok := c.inflight[key]; ok {
+		c.Unlock()
+		atomic.AddUint64(&c.coalesced, 1)
+		<-call.done
+		result := call.result.copyFor(query)
+		result.coalesced = true
+		return result
+	}
+	call := &inflightExchange{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.Unlock()
+
+	atomic.AddUint64(&c.exchanges, 1)
+	call.result = exchange(query)
+	c.Lock()
+	delete(c.inflight, key)
+	c.Unlock()
+	close(call.done)
+	return call.result.copyFor(query)
+}
+
+// copyFor returns the result with a copy of the response suited to query.
+func (r upstreamResolution) copyFor(query *dns.Msg) upstreamResolution {
+	if r.response != nil {
+		r.response = replyCopy(query, r.response)
+	}
+	r.attempts = append([]upstreamAttempt(nil), r.attempts...)
+	return r
+}
+
+func (c *queryCoalescer) report(now time.Time) {
+	if c.telemetryClient == nil {
+		return
+	}
+	e := coalesceEvent{
+		Event:        "coalesced_queries",
+		Exchanges:    atomic.LoadUint64(&c.exchanges),
+		Coalesced:    atomic.LoadUint64(&c.coalesced),
+		Timestamp:    now.UnixNano(),
+		IngestedFrom: c.serverInstanceName,
+		ExperimentID: c.experimentId,
+	}
+	c.telemetryClient.stream([]string{e.serialize()})
+}
@@ -0,0 +1,163 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCoalescerSharesExchange(t *testing.T) {
+	coalescer := newQueryCoalescer()
+	release := make(chan struct{})
+	exchanges := new(int32)
+	exchange := func(query *dns.Msg) upstreamResolution {
+		atomic.AddInt32(exchanges, 1)
+		<-release
+		response := answerA(query, "192.0.2.1")
+		response.SetEdns0(1232, false)
+		return upstreamResolution{response: response}
+	}
+
+	leader := questionFor("example.com.")
+	leader.SetEdns0(1232, false)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if r := coalescer.do(leader, exchange); r.coalesced || r.response.Id != leader.Id {
+			t.Errorf("Unexpected result for the first query %+v", r)
+		}
+	}()
+	for i := 0; ; i++ {
+		coalescer.Lock()
+		started := len(coalescer.inflight) == 1
+		coalescer.Unlock()
+		if started {
+			break
+		} else if i == 100 {
+			t.Fatal("Exchange not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const followers = 10
+	for i := 0; i < followers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := questionFor("EXAMPLE.com.")
+			r := coalescer.do(query, exchange)
+			if !r.coalesced || r.response.Id != query.Id || r.response.Question[0].Name != "EXAMPLE.com." {
+				t.Errorf("Unexpected result for a coalesced query %+v", r)
+			}
+			if r.response.IsEdns0() != nil {
+				t.Error("Answer to a query without EDNS has an OPT record")
+			}
+		}()
+	}
+	for i := 0; atomic.LoadUint64(&coalescer.coalesced) < followers; i++ {
+		if i == 100 {
+			t.Fatal("Queries not coalesced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(exchanges) != 1 || coalescer.exchanges != 1 {
+		t.Fatalf("Made %d exchanges", atomic.LoadInt32(exchanges))
+	}
+	if len(coalescer.inflight) != 0 {
+		t.Fatal("Exchange still in flight")
+	}
+}
+
+func TestCoalescerKeepsDistinctQueriesApart(t *testing.T) {
+	coalescer := newQueryCoalescer()
+	release := make(chan struct{})
+	exchange := func(query *dns.Msg) upstreamResolution {
+		<-release
+		return upstreamResolution{response: answerA(query, "192.0.2.1")}
+	}
+
+	aaaa := &dns.Msg{}
+	aaaa.SetQuestion("example.com.", dns.TypeAAAA)
+	signed := questionFor("example.com.")
+	signed.SetEdns0(1232, true)
+	queries := []*dns.Msg{questionFor("example.com."), aaaa, signed, questionFor("example.net.")}
+
+	var wg sync.WaitGroup
+	for _, query := range queries {
+		wg.Add(1)
+		go func(query *dns.Msg) {
+			defer wg.Done()
+			if r := coalescer.do(query, exchange); r.coalesced {
+				t.Errorf("Query for %v coalesced", query.Question[0])
+			}
+		}(query)
+	}
+	for i := 0; ; i++ {
+		coalescer.Lock()
+		inflight := len(coalescer.inflight)
+		coalescer.Unlock()
+		if inflight == len(queries) {
+			break
+		} else if i == 100 {
+			t.Fatalf("%d exchanges in flight", inflight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestTargetCoalescesQueries(t *testing.T) {
+	r := &countingResolver{delay: 200 * time.Millisecond}
+	target := createTarget(t, r)
+	target.coalescer = newQueryCoalescer()
+
+	var wg sync.WaitGroup
+	coalesced := new(int32)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exp := experiment{}
+			if _, err := target.resolveQuery(questionFor("example.com."), &exp); err != nil {
+				t.Error(err)
+			}
+			if exp.Coalesced {
+				atomic.AddInt32(coalesced, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt32(&r.calls); calls != 1 || atomic.LoadInt32(coalesced) != 4 {
+		t.Fatalf("Upstream queried %d times, %d queries coalesced", calls, atomic.LoadInt32(coalesced))
+	}
+}
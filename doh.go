@@ -0,0 +1,143 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errUpstreamStatus = errors.New("upstream HTTP error")
+
+// dohClient is shared by every DoH upstream, so that connections to the same
+// server are reused and multiplexed over HTTP/2.
+var dohClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 1024,
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+	},
+}
+
+// dohResolver forwards queries to a DNS-over-HTTPS server (RFC 8484), with
+// POST requests by default or GET requests when the method option is get.
+// Queries are sent with ID 0 so that GET responses can be cached by HTTP
+// intermediaries.
+type dohResolver struct {
+	url     string
+	useGET  bool
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newDoHResolver(config upstreamConfig) (resolver, error) {
+	if err := config.checkOptions("method"); err != nil {
+		return nil, err
+	}
+	r := &dohResolver{
+		timeout: config.timeout,
+		client:  dohClient,
+	}
+	switch method := config.options.Get("method"); method {
+	case "", "post":
+	case "get":
+		r.useGET = true
+	default:
+		return nil, fmt.Errorf("upstream %s: unsupported method %q", config.name, method)
+	}
+
+	serverURL := *config.url
+	serverURL.RawQuery = ""
+	r.url = serverURL.String()
+	return r, nil
+}
+
+func (s *dohResolver) name() string {
+	return s.url
+}
+
+func (s *dohResolver) newRequest(ctx context.Context, packedQuery []byte) (*http.Request, error) {
+	if s.useGET {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"?dns="+url.QueryEscape(encodeDNSParameter(packedQuery)), nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", dnsMessageContentType)
+		return request, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(packedQuery))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", dnsMessageContentType)
+	request.Header.Set("Accept", dnsMessageContentType)
+	return request, nil
+}
+
+func (s *dohResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	upstreamQuery := query.Copy()
+	upstreamQuery.Id = 0
+	packedQuery, err := upstreamQuery.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	request, err := s.newRequest(ctx, packedQuery)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(httpResponse.Body, dns.MaxMsgSize))
+		return nil, fmt.Errorf("%w: %s", errUpstreamStatus, httpResponse.Status)
+	}
+	response, err := readDNSMessage(httpResponse.Body, httpResponse.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if !matchesQuestion(upstreamQuery, response) {
+		return nil, fmt.Errorf("upstream answered a different question")
+	}
+
+	response.Id = query.Id
+	return response, nil
+}
@@ -0,0 +1,167 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startDoHServer serves handler over HTTP/2 and returns a DoH upstream for it.
+func startDoHServer(t *testing.T, handler http.HandlerFunc, options string) (*dohResolver, func()) {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	u, err := newUpstream(server.URL + queryEndpoint + options)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	r := u.resolver.(*dohResolver)
+	r.client = server.Client()
+	return r, server.Close
+}
+
+func TestDoHResolverAgainstTarget(t *testing.T) {
+	local := createLocalResolver(t)
+	target := createTarget(t, local)
+
+	// The DoH resolver sends queries with ID 0.
+	query := new(dns.Msg)
+	if err := query.Unpack([]byte(local.queries[0])); err != nil {
+		t.Fatal(err)
+	}
+	query.Id = 0
+	packedQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(local.queryResponseMap[local.queries[0]]); err != nil {
+		t.Fatal(err)
+	}
+	response.Id = 0
+	if local.queryResponseMap[string(packedQuery)], err = response.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	query.Id = 1234
+
+	for _, options := range []string{"", "?method=get"} {
+		var protocol string
+		var method string
+		r, shutdown := startDoHServer(t, func(w http.ResponseWriter, r *http.Request) {
+			protocol, method = r.Proto, r.Method
+			// The target dispatches on the content type, which GET
+			// requests do not carry.
+			r.Header.Set("Content-Type", dnsMessageContentType)
+			target.targetQueryHandler(w, r)
+		}, options)
+		response, err := r.resolve(context.Background(), query)
+		shutdown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Id != 1234 || len(response.Answer) != 1 {
+			t.Fatalf("Unexpected response %v", response)
+		}
+		if protocol != "HTTP/2.0" {
+			t.Fatalf("Query sent over %s", protocol)
+		}
+		if expected := map[string]string{"": http.MethodPost, "?method=get": http.MethodGet}[options]; method != expected {
+			t.Fatalf("Query sent with %s instead of %s", method, expected)
+		}
+	}
+}
+
+func TestDoHResolverContentTypeParameters(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	r, shutdown := startDoHServer(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamQuery, err := readDNSMessage(r.Body, r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, _ := answerA(upstreamQuery, "192.0.2.1").Pack()
+		w.Header().Set("Content-Type", dnsMessageContentType+"; charset=utf-8")
+		w.Write(packed)
+	}, "")
+	defer shutdown()
+
+	response, err := r.resolve(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 1 {
+		t.Fatalf("Unexpected response %v", response)
+	}
+}
+
+func TestDoHResolverErrors(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	r, shutdown := startDoHServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}, "")
+	_, err := r.resolve(context.Background(), query)
+	shutdown()
+	if !errors.Is(err, errUpstreamStatus) {
+		t.Fatalf("Expected an upstream status error, got %v", err)
+	}
+
+	r, shutdown = startDoHServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}, "")
+	_, err = r.resolve(context.Background(), query)
+	shutdown()
+	if err == nil {
+		t.Fatal("Accepted a response that is not a DNS message")
+	}
+
+	r, shutdown = startDoHServer(t, func(w http.ResponseWriter, r *http.Request) {
+		other := new(dns.Msg)
+		other.SetQuestion("example.net.", dns.TypeA)
+		packed, _ := answerA(other, "192.0.2.1").Pack()
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(packed)
+	}, "")
+	_, err = r.resolve(context.Background(), query)
+	shutdown()
+	if err == nil {
+		t.Fatal("Accepted an answer to a different question")
+	}
+}
+
+func TestDoHResolverInvalidMethod(t *testing.T) {
+	if _, err := newUpstream("https://dns.example/dns-query?method=put"); err == nil {
+		t.Fatal("Method put should be rejected")
+	}
+}
@@ -0,0 +1,176 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDoTPort = "853"
+
+	spkiPinPrefix = "sha256/"
+)
+
+var errPinMismatch = errors.New("no certificate matches the SPKI pins")
+
+// tlsResolver forwards queries to a DNS-over-TLS server (RFC 7858) over pooled
+// connections. With SPKI pins and no server name, it follows the
+// out-of-band key-pinned privacy profile: the key of the server certificate
+// must be pinned, and the certificate is not otherwise verified. Otherwise the
+// certificate is verified against the server name, which defaults to the
+// upstream host, and the verified chain must also contain a pinned key when
+// there are any pins.
+type tlsResolver struct {
+	nameserver string
+	pool       *tcpPool
+}
+
+// parseSPKIPins decodes pins of the form sha256/<base64 digest>.
+func parseSPKIPins(config upstreamConfig) ([][]byte, error) {
+	pins := make([][]byte, 0)
+	for _, setting := range config.options["pin"] {
+		for _, pin := range strings.Split(setting, ",") {
+			if !strings.HasPrefix(pin, spkiPinPrefix) {
+				return nil, fmt.Errorf("upstream %s: pin %q is not a %s pin", config.name, pin, spkiPinPrefix)
+			}
+			digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("upstream %s: invalid pin %q", config.name, pin)
+			}
+			pins = append(pins, digest)
+		}
+	}
+	return pins, nil
+}
+
+// spkiPin returns the pin of the public key of certificate.
+func spkiPin(certificate *x509.Certificate) []byte {
+	digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+
+// verifyPins checks that one of certificates carries a pinned key.
+func verifyPins(pins [][]byte, certificates []*x509.Certificate) error {
+	for _, certificate := range certificates {
+		pin := spkiPin(certificate)
+		for _, expected := range pins {
+			if subtle.ConstantTimeCompare(pin, expected) == 1 {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+func dotTLSConfig(config upstreamConfig) (*tls.Config, error) {
+	pins, err := parseSPKIPins(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.options.Get("servername"),
+	}
+	if caFile := config.options.Get("ca"); caFile != "" {
+		if tlsConfig.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", config.name, err)
+		}
+	}
+	if len(pins) > 0 {
+		if tlsConfig.ServerName == "" {
+			// The handshake only proves that the server holds the key of
+			// the leaf: the rest of an unverified chain can be anything.
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errPinMismatch
+				}
+				leaf, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				return verifyPins(pins, []*x509.Certificate{leaf})
+			}
+		} else {
+			tlsConfig.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+				for _, chain := range verifiedChains {
+					if verifyPins(pins, chain) == nil {
+						return nil
+					}
+				}
+				return errPinMismatch
+			}
+		}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = config.url.Hostname()
+	}
+	return tlsConfig, nil
+}
+
+func newTLSResolver(config upstreamConfig) (resolver, error) {
+	if err := config.checkOptions("servername", "pin", "ca", "connections"); err != nil {
+		return nil, err
+	}
+	connections, err := parseConnections(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := dotTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	nameserver := config.address(defaultDoTPort)
+	timeout := config.timeout
+	// The dialer timeout also bounds the TLS handshake.
+	dial := func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: timeout}
+		return tls.DialWithDialer(dialer, "tcp", nameserver, tlsConfig)
+	}
+	return tlsResolver{
+		nameserver: nameserver,
+		pool:       newTCPPool(dial, timeout, connections),
+	}, nil
+}
+
+func (s tlsResolver) name() string {
+	return s.nameserver
+}
+
+func (s tlsResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	return s.pool.exchange(ctx, query)
+}
@@ -0,0 +1,227 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type dotServer struct {
+	address     string
+	accepted    *int32
+	caFile      string
+	certificate *x509.Certificate
+	shutdown    func()
+}
+
+// dotImpostor is how a DoT test server impersonates the genuine one, whose
+// certificate it appends to its own.
+type dotImpostor int
+
+const (
+	genuineServer dotImpostor = iota
+	selfSignedImpostor
+	caSignedImpostor
+)
+
+// startDoTServer serves DNS over TLS with a certificate for dns.example issued
+// by a CA written to a temporary file.
+func startDoTServer(t *testing.T) *dotServer {
+	return startImpostorDoTServer(t, genuineServer)
+}
+
+// startImpostorDoTServer starts a DoT server that presents its own
+// certificate for dns.example followed by the genuine one.
+func startImpostorDoTServer(t *testing.T, impostor dotImpostor) *dotServer {
+	now := time.Now()
+	caCertificate, caKey := createCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "DoT CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCertificate, serverKey := createCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "dns.example"},
+		DNSNames:     []string{"dns.example"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCertificate, caKey)
+
+	directory, err := ioutil.TempDir("", "odoh-dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(directory, "ca.pem")
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCertificate.Raw})
+	if err := ioutil.WriteFile(caFile, encoded, 0600); err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+
+	presented := tls.Certificate{
+		Certificate: [][]byte{serverCertificate.Raw},
+		PrivateKey:  serverKey,
+	}
+	if impostor != genuineServer {
+		parent, parentKey := caCertificate, caKey
+		if impostor == selfSignedImpostor {
+			parent, parentKey = nil, nil
+		}
+		impostorCertificate, impostorKey := createCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "dns.example"},
+			DNSNames:     []string{"dns.example"},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, parent, parentKey)
+		presented = tls.Certificate{
+			Certificate: [][]byte{impostorCertificate.Raw, serverCertificate.Raw},
+			PrivateKey:  impostorKey,
+		}
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{presented},
+	})
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+	address, accepted, shutdown := serveListener(listener, answerAll)
+	return &dotServer{
+		address:     address,
+		accepted:    accepted,
+		caFile:      caFile,
+		certificate: serverCertificate,
+		shutdown: func() {
+			shutdown()
+			os.RemoveAll(directory)
+		},
+	}
+}
+
+func createTLSResolver(t *testing.T, server *dotServer, options url.Values) resolver {
+	options.Set("timeout", "1s")
+	u, err := newUpstream("tls://" + server.address + "?" + options.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestTLSResolverVerifiesServerName(t *testing.T) {
+	server := startDoTServer(t)
+	defer server.shutdown()
+
+	r := createTLSResolver(t, server, url.Values{"servername": {"dns.example"}, "ca": {server.caFile}})
+	for i := 0; i < 3; i++ {
+		resolveName(t, r, "example.com.")
+	}
+	if n := atomic.LoadInt32(server.accepted); n != 1 {
+		t.Fatalf("Expected a single connection, got %d", n)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	r = createTLSResolver(t, server, url.Values{"servername": {"other.example"}, "ca": {server.caFile}})
+	if _, err := r.resolve(context.Background(), query); err == nil {
+		t.Fatal("Connected to a server with a certificate for another name")
+	}
+	r = createTLSResolver(t, server, url.Values{"servername": {"dns.example"}})
+	if _, err := r.resolve(context.Background(), query); err == nil {
+		t.Fatal("Connected to a server with a certificate from an unknown CA")
+	}
+}
+
+func TestTLSResolverSPKIPin(t *testing.T) {
+	server := startDoTServer(t)
+	defer server.shutdown()
+
+	pin := spkiPinPrefix + base64.StdEncoding.EncodeToString(spkiPin(server.certificate))
+	resolveName(t, createTLSResolver(t, server, url.Values{"pin": {pin}}), "example.com.")
+
+	otherCertificate, _ := createCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(3)}, nil, nil)
+	otherPin := spkiPinPrefix + base64.StdEncoding.EncodeToString(spkiPin(otherCertificate))
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	r := createTLSResolver(t, server, url.Values{"pin": {otherPin}})
+	if _, err := r.resolve(context.Background(), query); err == nil {
+		t.Fatal("Connected to a server without a pinned key")
+	}
+
+	r = createTLSResolver(t, server, url.Values{"pin": {otherPin}, "servername": {"dns.example"}, "ca": {server.caFile}})
+	if _, err := r.resolve(context.Background(), query); err == nil {
+		t.Fatal("A valid certificate bypassed the pins")
+	}
+}
+
+func TestTLSResolverSPKIPinRejectsImpostor(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	for _, impostor := range []dotImpostor{selfSignedImpostor, caSignedImpostor} {
+		server := startImpostorDoTServer(t, impostor)
+		pin := spkiPinPrefix + base64.StdEncoding.EncodeToString(spkiPin(server.certificate))
+
+		r := createTLSResolver(t, server, url.Values{"pin": {pin}})
+		if _, err := r.resolve(context.Background(), query); err == nil {
+			t.Fatalf("Impostor %d passed a pin on a certificate it does not hold the key of", impostor)
+		}
+		if impostor == caSignedImpostor {
+			r = createTLSResolver(t, server, url.Values{"pin": {pin}, "servername": {"dns.example"}, "ca": {server.caFile}})
+			if _, err := r.resolve(context.Background(), query); err == nil {
+				t.Fatal("Pin matched a certificate outside the verified chain")
+			}
+		}
+		server.shutdown()
+	}
+}
+
+func TestParseSPKIPinsInvalid(t *testing.T) {
+	for _, pin := range []string{"sha1/AAAA", "sha256/not-base64", "sha256/AAAA"} {
+		if _, err := newUpstream("tls://" + net.JoinHostPort("127.0.0.1", "853") + "?pin=" + url.QueryEscape(pin)); err == nil {
+			t.Fatalf("Pin %q should be rejected", pin)
+		}
+	}
+}
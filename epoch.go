@@ -0,0 +1,91 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+const (
+	// HKDF labels for fleet key derivation
+	epochSeedSalt  = "odoh-server-go fleet key"
+	epochSeedLabel = "odoh epoch seed"
+
+	defaultEpochLength = 24 * time.Hour
+)
+
+// epochKeyDeriver maps wall-clock time to numbered epochs and derives the key
+// pair of each epoch from a master secret. Every instance sharing the secret
+// and epoch length computes identical keys, so a fleet rotates in lockstep
+// without talking to each other.
+type epochKeyDeriver struct {
+	masterSecret []byte
+	epochLength  time.Duration
+}
+
+func (d *epochKeyDeriver) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(d.epochLength)
+}
+
+func (d *epochKeyDeriver) epochStart(epoch int64) time.Time {
+	return time.Unix(0, epoch*int64(d.epochLength))
+}
+
+// seed expands the master secret into the seed of the given epoch and cipher
+// suite, using the suite's KDF:
+//
+//	prk  = HKDF-Extract(epochSeedSalt, masterSecret)
+//	seed = HKDF-Expand(prk, epochSeedLabel || uint64(epoch) || suite IDs, defaultSeedLength)
+func (d *epochKeyDeriver) seed(epoch int64, suite cipherSuite) ([]byte, error) {
+	hpkeSuite, err := suite.hpkeSuite()
+	if err != nil {
+		return nil, err
+	}
+
+	context := make([]byte, 14)
+	binary.BigEndian.PutUint64(context[0:], uint64(epoch))
+	binary.BigEndian.PutUint16(context[8:], uint16(suite.kemID))
+	binary.BigEndian.PutUint16(context[10:], uint16(suite.kdfID))
+	binary.BigEndian.PutUint16(context[12:], uint16(suite.aeadID))
+	info := append([]byte(epochSeedLabel), context...)
+
+	prk := hpkeSuite.KDF.Extract([]byte(epochSeedSalt), d.masterSecret)
+	return hpkeSuite.KDF.Expand(prk, info, defaultSeedLength), nil
+}
+
+func (d *epochKeyDeriver) keyPair(epoch int64, suite cipherSuite) (odoh.ObliviousDoHKeyPair, error) {
+	seed, err := d.seed(epoch, suite)
+	if err != nil {
+		return odoh.ObliviousDoHKeyPair{}, err
+	}
+
+	keyPair, err := suite.keyPairFromSeed(seed)
+	if err != nil {
+		return odoh.ObliviousDoHKeyPair{}, fmt.Errorf("deriving %v key for epoch %d: %v", suite, epoch, err)
+	}
+	return keyPair, nil
+}
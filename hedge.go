@@ -0,0 +1,85 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// Number of recent upstream latencies the hedge delay is computed from,
+	// and how many are needed before queries are hedged
+	hedgeLatencySamples    = 512
+	minHedgeLatencySamples = 20
+
+	defaultHedgeMinDelay = 10 * time.Millisecond
+)
+
+func parseHedgePercentile(setting string) (float64, error) {
+	percentile, err := strconv.ParseFloat(setting, 64)
+	if err != nil || percentile <= 0 || percentile >= 100 {
+		return 0, fmt.Errorf("invalid hedge percentile %q", setting)
+	}
+	return percentile, nil
+}
+
+// recordLatencyLocked adds the latency of a successful query to the window
+// hedge delays are computed from.
+func (s *upstreamSelector) recordLatencyLocked(latency time.Duration) {
+	if len(s.latencies) < hedgeLatencySamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	s.latencies[s.nextLatency] = latency
+	s.nextLatency = (s.nextLatency + 1) % hedgeLatencySamples
+}
+
+// hedgeDelay returns how long to wait for the first upstream before sending
+// the query to a second one: the hedge percentile of recent latencies, and at
+// least hedgeMinDelay. It returns false if hedging is disabled or too few
+// latencies are known yet.
+func (s *upstreamSelector) hedgeDelay() (time.Duration, bool) {
+	if s.hedgePercentile == 0 || s.maxAttempts < 2 {
+		return 0, false
+	}
+
+	s.Lock()
+	if len(s.latencies) < minHedgeLatencySamples {
+		s.Unlock()
+		return 0, false
+	}
+	latencies := make([]time.Duration, len(s.latencies))
+	copy(latencies, s.latencies)
+	s.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := int(math.Ceil(s.hedgePercentile/100*float64(len(latencies)))) - 1
+	if delay := latencies[rank]; delay > s.hedgeMinDelay {
+		return delay, true
+	}
+	return s.hedgeMinDelay, true
+}
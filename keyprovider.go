@@ -0,0 +1,188 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+// Errors a key provider reports for queries it cannot decrypt. Any other error
+// means the provider itself failed.
+var (
+	errInvalidQuery = errors.New("invalid oblivious query")
+)
+
+// keyProvider holds the private ODoH keys of the target. It decrypts queries
+// and hands back the context needed to encrypt their responses, so that the
+// private keys can live outside of the target process, e.g. in a KMS or HSM.
+type keyProvider interface {
+	// decryptQuery returns errUnknownKey if the query is encrypted to a key
+	// the provider does not hold, and errInvalidQuery if it cannot be
+	// decrypted.
+	decryptQuery(message odoh.ObliviousDNSMessage) (*odoh.ObliviousDNSQuery, responseEncrypter, error)
+	// publicConfigs returns the configs advertised to clients.
+	publicConfigs() (odoh.ObliviousDoHConfigs, error)
+}
+
+// responseEncrypter encrypts the response to a decrypted query.
+// odoh.ResponseContext implements it.
+type responseEncrypter interface {
+	EncryptResponse(response *odoh.ObliviousDNSResponse) (odoh.ObliviousDNSMessage, error)
+}
+
+// decryptQuery implements keyProvider with the keys held in process.
+func (k *targetKeySet) decryptQuery(message odoh.ObliviousDNSMessage) (*odoh.ObliviousDNSQuery, responseEncrypter, error) {
+	keyPair, ok := k.keyPairForID(message.KeyID)
+	if !ok {
+		return nil, nil, errUnknownKey
+	}
+
+	suite, err := cipherSuiteOf(keyPair.Config.Contents).hpkeSuite()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(message.EncryptedMessage) < suite.KEM.PublicKeySize() {
+		return nil, nil, fmt.Errorf("%w: truncated encapsulated key", errInvalidQuery)
+	}
+
+	query, responseContext, err := keyPair.DecryptQuery(message)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	return query, responseContext, nil
+}
+
+func (k *targetKeySet) publicConfigs() (odoh.ObliviousDoHConfigs, error) {
+	return k.configs(), nil
+}
+
+func encodeLengthPrefixed(value []byte) []byte {
+	encoded := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(encoded, uint16(len(value)))
+	return append(encoded, value...)
+}
+
+// openQuery decrypts an ODoH query with keyPair as odoh.ObliviousDoHKeyPair
+// does, but also returns the secret exported for the response. The private key
+// is derived from the seed of keyPair.
+func openQuery(keyPair odoh.ObliviousDoHKeyPair, message odoh.ObliviousDNSMessage) (*odoh.ObliviousDNSQuery, []byte, error) {
+	if message.MessageType != odoh.QueryType {
+		return nil, nil, fmt.Errorf("%w: message is not a query", errInvalidQuery)
+	}
+
+	suite, err := cipherSuiteOf(keyPair.Config.Contents).hpkeSuite()
+	if err != nil {
+		return nil, nil, err
+	}
+	secretKey, _, err := suite.KEM.DeriveKeyPair(keyPair.Seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keySize := suite.KEM.PublicKeySize()
+	if len(message.EncryptedMessage) < keySize {
+		return nil, nil, fmt.Errorf("%w: truncated encapsulated key", errInvalidQuery)
+	}
+	enc := message.EncryptedMessage[:keySize]
+	ciphertext := message.EncryptedMessage[keySize:]
+
+	receiver, err := hpke.SetupBaseR(suite, secretKey, enc, []byte(odoh.ODOH_LABEL_QUERY))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	secret := receiver.Export([]byte(odoh.ODOH_LABEL_RESPONSE), suite.AEAD.KeySize())
+
+	aad := append([]byte{byte(odoh.QueryType)}, encodeLengthPrefixed(keyPair.Config.Contents.KeyID())...)
+	plaintext, err := receiver.Open(aad, ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+
+	query, err := parseQueryBody(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query, secret, nil
+}
+
+// parseQueryBody decodes a decrypted query body, rejecting truncated bodies and
+// non-zero padding.
+func parseQueryBody(plaintext []byte) (*odoh.ObliviousDNSQuery, error) {
+	if len(plaintext) < 4 {
+		return nil, fmt.Errorf("%w: truncated query body", errInvalidQuery)
+	}
+	query, err := odoh.UnmarshalQueryBody(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	for _, b := range query.Padding {
+		if b != odoh.ODOH_PADDING_BYTE {
+			return nil, fmt.Errorf("%w: invalid padding", errInvalidQuery)
+		}
+	}
+	return query, nil
+}
+
+// exportedResponseContext encrypts responses from the secret exported while
+// decrypting the query, for providers that keep the HPKE context to
+// themselves.
+type exportedResponseContext struct {
+	suite  hpke.CipherSuite
+	query  []byte
+	secret []byte
+}
+
+func (c exportedResponseContext) EncryptResponse(response *odoh.ObliviousDNSResponse) (odoh.ObliviousDNSMessage, error) {
+	nonceSize := c.suite.AEAD.KeySize()
+	if nonceSize < c.suite.AEAD.NonceSize() {
+		nonceSize = c.suite.AEAD.NonceSize()
+	}
+	responseNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(responseNonce); err != nil {
+		return odoh.ObliviousDNSMessage{}, err
+	}
+
+	encodedResponseNonce := encodeLengthPrefixed(responseNonce)
+	salt := append(append([]byte{}, c.query...), encodedResponseNonce...)
+	prk := c.suite.KDF.Extract(salt, c.secret)
+	key := c.suite.KDF.Expand(prk, []byte(odoh.ODOH_LABEL_KEY), c.suite.AEAD.KeySize())
+	nonce := c.suite.KDF.Expand(prk, []byte(odoh.ODOH_LABEL_NONCE), c.suite.AEAD.NonceSize())
+
+	aead, err := c.suite.AEAD.New(key)
+	if err != nil {
+		return odoh.ObliviousDNSMessage{}, err
+	}
+	aad := append([]byte{byte(odoh.ResponseType)}, encodedResponseNonce...)
+
+	return odoh.ObliviousDNSMessage{
+		MessageType:      odoh.ResponseType,
+		KeyID:            responseNonce,
+		EncryptedMessage: aead.Seal(nil, nonce, response.Marshal(), aad),
+	}, nil
+}
@@ -0,0 +1,419 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+type keyState int
+
+const (
+	// Active keys are published and used by clients for new queries.
+	keyStateActive keyState = iota
+	// Retiring keys are no longer published, but queries encrypted to them are
+	// still accepted until their grace period ends.
+	keyStateRetiring
+	// Pending keys are accepted but not yet published, e.g. the next key of a
+	// fleet that rotates in lockstep.
+	keyStatePending
+	// Retired keys are no longer accepted. They only appear in the keystore,
+	// which keeps their metadata but not their secret.
+	keyStateRetired
+	// Revoked keys were withdrawn immediately, e.g. after a compromise. Like
+	// retired keys they only appear in the keystore.
+	keyStateRevoked
+)
+
+var (
+	errUnknownKey      = errors.New("unknown key")
+	errInvalidKeyState = errors.New("key is not in a suitable state")
+	errLastActiveKey   = errors.New("key is the last active key")
+)
+
+func (s keyState) String() string {
+	switch s {
+	case keyStateActive:
+		return "active"
+	case keyStateRetiring:
+		return "retiring"
+	case keyStatePending:
+		return "pending"
+	case keyStateRetired:
+		return "retired"
+	case keyStateRevoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+func parseKeyState(state string) (keyState, error) {
+	for _, s := range []keyState{keyStateActive, keyStateRetiring, keyStatePending, keyStateRetired, keyStateRevoked} {
+		if s.String() == state {
+			return s, nil
+		}
+	}
+	return keyStateActive, fmt.Errorf("unknown key state %q", state)
+}
+
+type targetKey struct {
+	keyID    []byte
+	keyPair  odoh.ObliviousDoHKeyPair
+	created  time.Time
+	state    keyState
+	retireAt time.Time
+}
+
+// targetKeySet holds every ODoH key pair the target currently accepts queries
+// for. Clients select a key by its identifier, so several configs can be
+// published and used side by side.
+//
+// When store is set, every change to a key is written through to it.
+type targetKeySet struct {
+	sync.RWMutex
+	keys  []targetKey
+	store *keyStore
+}
+
+func newTargetKeySet(keyPairs ...odoh.ObliviousDoHKeyPair) *targetKeySet {
+	keySet := &targetKeySet{}
+	for _, keyPair := range keyPairs {
+		keySet.add(keyPair)
+	}
+	return keySet
+}
+
+func (k *targetKeySet) add(keyPair odoh.ObliviousDoHKeyPair) {
+	k.Lock()
+	defer k.Unlock()
+	if k.indexLocked(keyPair.Config.Contents.KeyID()) < 0 {
+		k.setLocked(keyPair, keyStateActive, time.Now(), time.Time{})
+	}
+}
+
+func (k *targetKeySet) indexLocked(keyID []byte) int {
+	for i, key := range k.keys {
+		if bytes.Equal(key.keyID, keyID) {
+			return i
+		}
+	}
+	return -1
+}
+
+// restore inserts a key exactly as it was persisted, without writing it back
+// to the store.
+func (k *targetKeySet) restore(key targetKey) {
+	k.Lock()
+	defer k.Unlock()
+	if k.indexLocked(key.keyID) < 0 {
+		k.keys = append(k.keys, key)
+	}
+}
+
+func (k *targetKeySet) persistLocked(key targetKey) {
+	if k.store == nil {
+		return
+	}
+	if err := k.store.save(key); err != nil {
+		log.Printf("Failed to persist ODoH key %x: %v", key.keyID, err)
+	}
+}
+
+// setLocked inserts keyPair in the given state, or moves an existing entry for
+// the same key to that state.
+func (k *targetKeySet) setLocked(keyPair odoh.ObliviousDoHKeyPair, state keyState, now time.Time, retireAt time.Time) []byte {
+	keyID := keyPair.Config.Contents.KeyID()
+	if i := k.indexLocked(keyID); i >= 0 {
+		k.keys[i].state = state
+		k.keys[i].retireAt = retireAt
+		k.persistLocked(k.keys[i])
+		return keyID
+	}
+	key := targetKey{
+		keyID:    keyID,
+		keyPair:  keyPair,
+		created:  now,
+		state:    state,
+		retireAt: retireAt,
+	}
+	k.keys = append(k.keys, key)
+	k.persistLocked(key)
+	return keyID
+}
+
+// set inserts keyPair in the given state if it is not already held. It reports
+// whether the key was added.
+func (k *targetKeySet) set(keyPair odoh.ObliviousDoHKeyPair, state keyState, now time.Time, retireAt time.Time) bool {
+	k.Lock()
+	defer k.Unlock()
+	if k.indexLocked(keyPair.Config.Contents.KeyID()) >= 0 {
+		return false
+	}
+	k.setLocked(keyPair, state, now, retireAt)
+	return true
+}
+
+// rotate publishes keyPairs as the only active keys, typically one per
+// configured cipher suite. Previously active keys move to the retiring state
+// and remain usable until retireAt. It returns the identifiers of the keys
+// that started retiring.
+func (k *targetKeySet) rotate(keyPairs []odoh.ObliviousDoHKeyPair, now time.Time, retireAt time.Time) [][]byte {
+	k.Lock()
+	defer k.Unlock()
+
+	isNew := func(keyID []byte) bool {
+		for _, keyPair := range keyPairs {
+			if bytes.Equal(keyPair.Config.Contents.KeyID(), keyID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	retiring := make([][]byte, 0)
+	for i := range k.keys {
+		if k.keys[i].state == keyStateActive && !isNew(k.keys[i].keyID) {
+			k.keys[i].state = keyStateRetiring
+			k.keys[i].retireAt = retireAt
+			k.persistLocked(k.keys[i])
+			retiring = append(retiring, k.keys[i].keyID)
+		}
+	}
+	for _, keyPair := range keyPairs {
+		k.setLocked(keyPair, keyStateActive, now, time.Time{})
+	}
+	return retiring
+}
+
+// expire drops retiring keys whose grace period has ended, returning their
+// identifiers.
+func (k *targetKeySet) expire(now time.Time) [][]byte {
+	k.Lock()
+	defer k.Unlock()
+
+	expired := make([][]byte, 0)
+	kept := k.keys[:0]
+	for _, key := range k.keys {
+		if key.state == keyStateRetiring && !now.Before(key.retireAt) {
+			key.state = keyStateRetired
+			k.persistLocked(key)
+			expired = append(expired, key.keyID)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.keys = kept
+	return expired
+}
+
+// keyPairForID returns the key pair queries encrypted to keyID are accepted
+// for. Retiring keys are refused once their grace period has ended, whether or
+// not expire has dropped them yet.
+func (k *targetKeySet) keyPairForID(keyID []byte) (odoh.ObliviousDoHKeyPair, bool) {
+	k.RLock()
+	defer k.RUnlock()
+	i := k.indexLocked(keyID)
+	if i < 0 {
+		return odoh.ObliviousDoHKeyPair{}, false
+	}
+	if k.keys[i].state == keyStateRetiring && !time.Now().Before(k.keys[i].retireAt) {
+		return odoh.ObliviousDoHKeyPair{}, false
+	}
+	return k.keys[i].keyPair, true
+}
+
+// promote makes a pending or retiring key active. Active keys of the same
+// cipher suite start retiring, so that the promoted key replaces them. It
+// returns the identifiers of the keys that started retiring.
+func (k *targetKeySet) promote(keyID []byte, retireAt time.Time) ([][]byte, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	i := k.indexLocked(keyID)
+	if i < 0 {
+		return nil, errUnknownKey
+	}
+	if k.keys[i].state == keyStateActive {
+		return nil, errInvalidKeyState
+	}
+
+	suite := cipherSuiteOf(k.keys[i].keyPair.Config.Contents)
+	retiring := make([][]byte, 0)
+	for j := range k.keys {
+		if k.keys[j].state == keyStateActive && cipherSuiteOf(k.keys[j].keyPair.Config.Contents) == suite {
+			k.keys[j].state = keyStateRetiring
+			k.keys[j].retireAt = retireAt
+			k.persistLocked(k.keys[j])
+			retiring = append(retiring, k.keys[j].keyID)
+		}
+	}
+	k.keys[i].state = keyStateActive
+	k.keys[i].retireAt = time.Time{}
+	k.persistLocked(k.keys[i])
+	return retiring, nil
+}
+
+// retire stops advertising an active or pending key, which remains accepted
+// until retireAt. The last active key cannot be retired.
+func (k *targetKeySet) retire(keyID []byte, retireAt time.Time) error {
+	k.Lock()
+	defer k.Unlock()
+
+	i := k.indexLocked(keyID)
+	if i < 0 {
+		return errUnknownKey
+	}
+	if k.keys[i].state != keyStateActive && k.keys[i].state != keyStatePending {
+		return errInvalidKeyState
+	}
+	if k.isLastActiveLocked(i) {
+		return errLastActiveKey
+	}
+
+	k.keys[i].state = keyStateRetiring
+	k.keys[i].retireAt = retireAt
+	k.persistLocked(k.keys[i])
+	return nil
+}
+
+// isLastActiveLocked reports whether the key at index i is the only active
+// key.
+func (k *targetKeySet) isLastActiveLocked(i int) bool {
+	if k.keys[i].state != keyStateActive {
+		return false
+	}
+	for j, key := range k.keys {
+		if j != i && key.state == keyStateActive {
+			return false
+		}
+	}
+	return true
+}
+
+// revoke drops a key immediately, whatever its state. If it was the last
+// active key of its cipher suite, a key made with generate replaces it in the
+// same step, so that clients are never left without a config; nothing changes
+// if that fails. It returns the identifier of the replacement, if any.
+func (k *targetKeySet) revoke(keyID []byte, generate func(suite cipherSuite) (odoh.ObliviousDoHKeyPair, error)) ([]byte, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	i := k.indexLocked(keyID)
+	if i < 0 {
+		return nil, errUnknownKey
+	}
+	key := k.keys[i]
+
+	var replacement odoh.ObliviousDoHKeyPair
+	replace := key.state == keyStateActive
+	suite := cipherSuiteOf(key.keyPair.Config.Contents)
+	for j, other := range k.keys {
+		if j != i && other.state == keyStateActive && cipherSuiteOf(other.keyPair.Config.Contents) == suite {
+			replace = false
+		}
+	}
+	if replace {
+		var err error
+		if replacement, err = generate(suite); err != nil {
+			return nil, err
+		}
+	}
+
+	key.state = keyStateRevoked
+	k.persistLocked(key)
+	k.keys = append(k.keys[:i], k.keys[i+1:]...)
+	if !replace {
+		return nil, nil
+	}
+	return k.setLocked(replacement, keyStateActive, time.Now(), time.Time{}), nil
+}
+
+type keyInfo struct {
+	KeyID    string     `json:"key_id"`
+	Suite    string     `json:"suite"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	RetireAt *time.Time `json:"retire_at,omitempty"`
+}
+
+func (key targetKey) info() keyInfo {
+	info := keyInfo{
+		KeyID:   hex.EncodeToString(key.keyID),
+		Suite:   cipherSuiteOf(key.keyPair.Config.Contents).String(),
+		State:   key.state.String(),
+		Created: key.created,
+	}
+	if key.state == keyStateRetiring {
+		retireAt := key.retireAt
+		info.RetireAt = &retireAt
+	}
+	return info
+}
+
+// describe returns a summary of every key held.
+func (k *targetKeySet) describe() []keyInfo {
+	k.RLock()
+	defer k.RUnlock()
+	infos := make([]keyInfo, 0, len(k.keys))
+	for _, key := range k.keys {
+		infos = append(infos, key.info())
+	}
+	return infos
+}
+
+// lastActivation returns the creation time of the newest active key, or the
+// zero time if there is none.
+func (k *targetKeySet) lastActivation() time.Time {
+	k.RLock()
+	defer k.RUnlock()
+	var newest time.Time
+	for _, key := range k.keys {
+		if key.state == keyStateActive && key.created.After(newest) {
+			newest = key.created
+		}
+	}
+	return newest
+}
+
+// configs returns the configs of all active keys, which is the set advertised
+// to clients.
+func (k *targetKeySet) configs() odoh.ObliviousDoHConfigs {
+	k.RLock()
+	defer k.RUnlock()
+	configSet := make([]odoh.ObliviousDoHConfig, 0, len(k.keys))
+	for _, key := range k.keys {
+		if key.state == keyStateActive {
+			configSet = append(configSet, key.keyPair.Config)
+		}
+	}
+	return odoh.CreateObliviousDoHConfigs(configSet)
+}
@@ -0,0 +1,236 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+const (
+	keyStoreVersion       = 1
+	keyStoreFileExtension = ".json"
+
+	keyStoreDirectoryMode = 0700
+	keyStoreFileMode      = 0600
+)
+
+// keyStore persists target keys in a directory, one JSON file per key named
+// after its hex-encoded key ID. Retired and revoked keys keep their metadata
+// but have their seed erased.
+type keyStore struct {
+	directory string
+}
+
+type keyStoreRecord struct {
+	Version  int       `json:"version"`
+	KeyID    string    `json:"key_id"`
+	KemID    uint16    `json:"kem_id"`
+	KdfID    uint16    `json:"kdf_id"`
+	AeadID   uint16    `json:"aead_id"`
+	Seed     string    `json:"seed,omitempty"`
+	Created  time.Time `json:"created"`
+	State    string    `json:"state"`
+	RetireAt time.Time `json:"retire_at"`
+}
+
+func checkKeyStorePermissions(path string, info os.FileInfo) error {
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("keystore path %s is accessible by other users (mode %04o)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// openKeyStore opens the keystore in directory, creating it if needed. It
+// fails if the directory can be accessed by anyone but its owner.
+func openKeyStore(directory string) (*keyStore, error) {
+	if err := os.MkdirAll(directory, keyStoreDirectoryMode); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(directory)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("keystore path %s is not a directory", directory)
+	}
+	if err := checkKeyStorePermissions(directory, info); err != nil {
+		return nil, err
+	}
+
+	return &keyStore{directory: directory}, nil
+}
+
+func (s *keyStore) path(keyID []byte) string {
+	return filepath.Join(s.directory, hex.EncodeToString(keyID)+keyStoreFileExtension)
+}
+
+// save writes key to its file, replacing any previous record atomically.
+func (s *keyStore) save(key targetKey) error {
+	contents := key.keyPair.Config.Contents
+	record := keyStoreRecord{
+		Version:  keyStoreVersion,
+		KeyID:    hex.EncodeToString(key.keyID),
+		KemID:    uint16(contents.KemID),
+		KdfID:    uint16(contents.KdfID),
+		AeadID:   uint16(contents.AeadID),
+		Created:  key.created,
+		State:    key.state.String(),
+		RetireAt: key.retireAt,
+	}
+	if key.state != keyStateRetired && key.state != keyStateRevoked {
+		record.Seed = hex.EncodeToString(key.keyPair.Seed)
+	}
+
+	encoded, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(s.path(key.keyID), encoded, keyStoreFileMode)
+}
+
+// writeFileAtomically replaces the file at path with contents, through a
+// temporary file in the same directory so that readers never see a partial
+// file.
+func writeFileAtomically(path string, contents []byte, mode os.FileMode) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if err := temporary.Chmod(mode); err != nil {
+		temporary.Close()
+		return err
+	}
+	if _, err := temporary.Write(contents); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+func (s *keyStore) loadRecord(path string) (targetKey, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return targetKey{}, err
+	}
+
+	var record keyStoreRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return targetKey{}, err
+	}
+	if record.Version != keyStoreVersion {
+		return targetKey{}, fmt.Errorf("unsupported version %d", record.Version)
+	}
+
+	state, err := parseKeyState(record.State)
+	if err != nil {
+		return targetKey{}, err
+	}
+
+	keyID, err := hex.DecodeString(record.KeyID)
+	if err != nil {
+		return targetKey{}, fmt.Errorf("invalid key ID: %v", err)
+	}
+	if filepath.Base(path) != hex.EncodeToString(keyID)+keyStoreFileExtension {
+		return targetKey{}, fmt.Errorf("key ID %s does not match the file name", record.KeyID)
+	}
+
+	key := targetKey{
+		keyID:    keyID,
+		created:  record.Created,
+		state:    state,
+		retireAt: record.RetireAt,
+	}
+	if state == keyStateRetired || state == keyStateRevoked {
+		return key, nil
+	}
+
+	seed, err := hex.DecodeString(record.Seed)
+	if err != nil || len(seed) == 0 {
+		return targetKey{}, fmt.Errorf("missing or invalid seed")
+	}
+	keyPair, err := odoh.CreateKeyPairFromSeed(hpke.KEMID(record.KemID), hpke.KDFID(record.KdfID), hpke.AEADID(record.AeadID), seed)
+	if err != nil {
+		return targetKey{}, err
+	}
+	if !bytes.Equal(keyPair.Config.Contents.KeyID(), keyID) {
+		return targetKey{}, fmt.Errorf("seed does not produce key ID %s", record.KeyID)
+	}
+	key.keyPair = keyPair
+	return key, nil
+}
+
+// load reads every key in the store. Retired and revoked keys are skipped. Any
+// unreadable, malformed or overly permissive file fails the whole load, since
+// serving with a partial key set would silently break clients.
+func (s *keyStore) load() ([]targetKey, error) {
+	entries, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]targetKey, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), keyStoreFileExtension) {
+			continue
+		}
+
+		path := filepath.Join(s.directory, entry.Name())
+		if !entry.Mode().IsRegular() {
+			return nil, fmt.Errorf("keystore entry %s is not a regular file", path)
+		}
+		if err := checkKeyStorePermissions(path, entry); err != nil {
+			return nil, err
+		}
+
+		key, err := s.loadRecord(path)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt keystore entry %s: %v", path, err)
+		}
+		if key.state != keyStateRetired && key.state != keyStateRevoked {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
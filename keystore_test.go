@@ -0,0 +1,162 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createKeyStore(t *testing.T) (*keyStore, func()) {
+	directory, err := ioutil.TempDir("", "odoh-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openKeyStore(filepath.Join(directory, "keys"))
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(directory) }
+}
+
+func TestKeyStoreRoundTrip(t *testing.T) {
+	store, cleanup := createKeyStore(t)
+	defer cleanup()
+
+	keys := newTargetKeySet()
+	keys.store = store
+	oldKeyPair := createKeyPair(t)
+	keys.add(oldKeyPair)
+
+	now := time.Now()
+	rotator := &keyRotator{
+		keys:        keys,
+		interval:    time.Hour,
+		gracePeriod: 10 * time.Minute,
+		generate:    cipherSuite.generateKeyPair,
+	}
+	if err := rotator.rotate(now); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("Expected 2 stored keys, got %d", len(loaded))
+	}
+
+	restored := newTargetKeySet()
+	for _, key := range loaded {
+		restored.restore(key)
+	}
+	if !bytes.Equal(restored.configs().Marshal(), keys.configs().Marshal()) {
+		t.Fatal("Restored keys advertise different configs")
+	}
+	if _, ok := restored.keyPairForID(oldKeyPair.Config.Contents.KeyID()); !ok {
+		t.Fatal("Retiring key was not restored")
+	}
+
+	keys.expire(now.Add(time.Hour))
+	loaded, err = store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("Expected 1 usable stored key after retirement, got %d", len(loaded))
+	}
+
+	encoded, err := ioutil.ReadFile(store.path(oldKeyPair.Config.Contents.KeyID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record keyStoreRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.State != keyStateRetired.String() || record.Seed != "" {
+		t.Fatalf("Retired key record was not scrubbed: %+v", record)
+	}
+}
+
+func TestKeyStoreRejectsPermissiveFiles(t *testing.T) {
+	store, cleanup := createKeyStore(t)
+	defer cleanup()
+
+	keys := newTargetKeySet()
+	keys.store = store
+	keyPair := createKeyPair(t)
+	keys.add(keyPair)
+
+	if err := os.Chmod(store.path(keyPair.Config.Contents.KeyID()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.load(); err == nil {
+		t.Fatal("Loaded a world-readable key file")
+	}
+
+	if err := os.Chmod(store.directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openKeyStore(store.directory); err == nil {
+		t.Fatal("Opened a world-readable keystore directory")
+	}
+}
+
+func TestKeyStoreRejectsCorruptFiles(t *testing.T) {
+	store, cleanup := createKeyStore(t)
+	defer cleanup()
+
+	keys := newTargetKeySet()
+	keys.store = store
+	keyPair := createKeyPair(t)
+	keys.add(keyPair)
+	path := store.path(keyPair.Config.Contents.KeyID())
+
+	if err := ioutil.WriteFile(path, []byte("{not json"), keyStoreFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.load(); err == nil {
+		t.Fatal("Loaded a malformed key file")
+	}
+
+	otherKeyPair := createKeyPair(t)
+	keys.add(otherKeyPair)
+	encoded, err := ioutil.ReadFile(store.path(otherKeyPair.Config.Contents.KeyID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, encoded, keyStoreFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.load(); err == nil {
+		t.Fatal("Loaded a key file whose contents do not match its name")
+	}
+}
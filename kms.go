@@ -0,0 +1,195 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+const (
+	kmsMethodDecrypt = "decrypt"
+	kmsMethodConfigs = "configs"
+
+	kmsCodeUnknownKey   = "unknown_key"
+	kmsCodeInvalidQuery = "invalid_query"
+
+	defaultKeyProviderTimeout = 2 * time.Second
+)
+
+// The key provider protocol exchanges one JSON object per line over a Unix
+// socket. A decrypt request carries a marshalled ODoH query; the provider
+// returns the decrypted query body along with the secret exported from the
+// HPKE context, from which the target encrypts the response.
+type kmsRequest struct {
+	Method  string `json:"method"`
+	Message []byte `json:"message,omitempty"`
+}
+
+type kmsResponse struct {
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Suite   string `json:"suite,omitempty"`
+	Query   []byte `json:"query,omitempty"`
+	Secret  []byte `json:"secret,omitempty"`
+	Configs []byte `json:"configs,omitempty"`
+}
+
+// socketKeyProvider is a keyProvider backed by an external signer listening
+// on a Unix socket. Each call opens its own connection.
+type socketKeyProvider struct {
+	path    string
+	timeout time.Duration
+}
+
+func (p *socketKeyProvider) call(request kmsRequest) (kmsResponse, error) {
+	connection, err := net.DialTimeout("unix", p.path, p.timeout)
+	if err != nil {
+		return kmsResponse{}, err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(p.timeout))
+
+	if err := json.NewEncoder(connection).Encode(request); err != nil {
+		return kmsResponse{}, err
+	}
+	var response kmsResponse
+	if err := json.NewDecoder(connection).Decode(&response); err != nil {
+		return kmsResponse{}, err
+	}
+
+	switch {
+	case response.Code == kmsCodeUnknownKey:
+		return kmsResponse{}, errUnknownKey
+	case response.Code == kmsCodeInvalidQuery:
+		return kmsResponse{}, fmt.Errorf("%w: %s", errInvalidQuery, response.Error)
+	case response.Error != "":
+		return kmsResponse{}, fmt.Errorf("key provider failed: %s", response.Error)
+	}
+	return response, nil
+}
+
+func (p *socketKeyProvider) decryptQuery(message odoh.ObliviousDNSMessage) (*odoh.ObliviousDNSQuery, responseEncrypter, error) {
+	response, err := p.call(kmsRequest{Method: kmsMethodDecrypt, Message: message.Marshal()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	suite, err := parseCipherSuite(response.Suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	hpkeSuite, err := suite.hpkeSuite()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(response.Secret) != hpkeSuite.AEAD.KeySize() {
+		return nil, nil, fmt.Errorf("key provider returned a %d byte secret", len(response.Secret))
+	}
+
+	query, err := parseQueryBody(response.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query, exportedResponseContext{
+		suite:  hpkeSuite,
+		query:  query.Marshal(),
+		secret: response.Secret,
+	}, nil
+}
+
+func (p *socketKeyProvider) publicConfigs() (odoh.ObliviousDoHConfigs, error) {
+	response, err := p.call(kmsRequest{Method: kmsMethodConfigs})
+	if err != nil {
+		return odoh.ObliviousDoHConfigs{}, err
+	}
+	return odoh.UnmarshalObliviousDoHConfigs(response.Configs)
+}
+
+// keyProviderServer is the reference implementation of the key provider
+// protocol. It answers with the keys of a targetKeySet, and stands in for a
+// KMS in tests.
+type keyProviderServer struct {
+	keys *targetKeySet
+}
+
+func (s *keyProviderServer) serve(listener net.Listener) error {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(connection)
+	}
+}
+
+func (s *keyProviderServer) handle(connection net.Conn) {
+	defer connection.Close()
+	decoder := json.NewDecoder(connection)
+	encoder := json.NewEncoder(connection)
+	for {
+		var request kmsRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		if err := encoder.Encode(s.respond(request)); err != nil {
+			log.Println("Failed writing key provider response:", err)
+			return
+		}
+	}
+}
+
+func (s *keyProviderServer) respond(request kmsRequest) kmsResponse {
+	switch request.Method {
+	case kmsMethodConfigs:
+		return kmsResponse{Configs: s.keys.configs().Marshal()}
+	case kmsMethodDecrypt:
+		message, err := odoh.UnmarshalDNSMessage(request.Message)
+		if err != nil {
+			return kmsResponse{Code: kmsCodeInvalidQuery, Error: err.Error()}
+		}
+		keyPair, ok := s.keys.keyPairForID(message.KeyID)
+		if !ok {
+			return kmsResponse{Code: kmsCodeUnknownKey, Error: errUnknownKey.Error()}
+		}
+		query, secret, err := openQuery(keyPair, message)
+		if errors.Is(err, errInvalidQuery) {
+			return kmsResponse{Code: kmsCodeInvalidQuery, Error: err.Error()}
+		} else if err != nil {
+			return kmsResponse{Error: err.Error()}
+		}
+		return kmsResponse{
+			Suite:  cipherSuiteOf(keyPair.Config.Contents).String(),
+			Query:  query.Marshal(),
+			Secret: secret,
+		}
+	default:
+		return kmsResponse{Error: fmt.Sprintf("unsupported method %q", request.Method)}
+	}
+}
@@ -0,0 +1,187 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+// createFakeKMS serves keys over a Unix socket and returns a provider
+// connected to it.
+func createFakeKMS(t *testing.T, keys *targetKeySet) (*socketKeyProvider, func()) {
+	directory, err := ioutil.TempDir("", "odoh-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(directory, "kms.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+
+	server := &keyProviderServer{keys: keys}
+	go server.serve(listener)
+
+	provider := &socketKeyProvider{path: path, timeout: time.Second}
+	return provider, func() {
+		listener.Close()
+		os.RemoveAll(directory)
+	}
+}
+
+func createKMSTarget(t *testing.T) (targetServer, *localResolver, odoh.ObliviousDoHConfig, func()) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+
+	kmsKeyPair := createKeyPair(t)
+	provider, cleanup := createFakeKMS(t, newTargetKeySet(kmsKeyPair))
+	target.keyProvider = provider
+	return target, r, kmsKeyPair.Config, cleanup
+}
+
+func postObliviousQuery(t *testing.T, target targetServer, message odoh.ObliviousDNSMessage) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(message.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", odohMessageContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.targetQueryHandler).ServeHTTP(rr, request)
+	return rr
+}
+
+func TestKeyProviderQuery(t *testing.T) {
+	target, r, config, cleanup := createKMSTarget(t)
+	defer cleanup()
+
+	q := r.queries[0]
+	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
+	encryptedQuery, context, err := config.Contents.EncryptQuery(obliviousQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postObliviousQuery(t, target, encryptedQuery)
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	responseBody, err := ioutil.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odohQueryResponse, err := odoh.UnmarshalDNSMessage(responseBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := context.OpenAnswer(odohQueryResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, r.queryResponseMap[q]) {
+		t.Fatal(fmt.Errorf("Incorrect response received. Got %v, expected %v", response, r.queryResponseMap[q]))
+	}
+}
+
+func TestKeyProviderIgnoresLocalKeys(t *testing.T) {
+	target, r, _, cleanup := createKMSTarget(t)
+	defer cleanup()
+
+	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(r.queries[0]), 0)
+	encryptedQuery, _, err := target.odohKeys.configs().Configs[0].Contents.EncryptQuery(obliviousQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postObliviousQuery(t, target, encryptedQuery)
+	if status := rr.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusUnauthorized, status))
+	}
+}
+
+func TestKeyProviderCorruptCiphertext(t *testing.T) {
+	target, r, config, cleanup := createKMSTarget(t)
+	defer cleanup()
+
+	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(r.queries[0]), 0)
+	encryptedQuery, _, err := config.Contents.EncryptQuery(obliviousQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedQuery.EncryptedMessage[len(encryptedQuery.EncryptedMessage)-1] ^= 0xFF
+
+	rr := postObliviousQuery(t, target, encryptedQuery)
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	}
+}
+
+func TestKeyProviderUnavailable(t *testing.T) {
+	target, r, config, cleanup := createKMSTarget(t)
+	cleanup()
+
+	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(r.queries[0]), 0)
+	encryptedQuery, _, err := config.Contents.EncryptQuery(obliviousQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postObliviousQuery(t, target, encryptedQuery)
+	if status := rr.Result().StatusCode; status != http.StatusInternalServerError {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusInternalServerError, status))
+	}
+}
+
+func TestKeyProviderConfigs(t *testing.T) {
+	target, _, config, cleanup := createKMSTarget(t)
+	defer cleanup()
+
+	request, err := http.NewRequest(http.MethodGet, configEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.configHandler).ServeHTTP(rr, request)
+
+	body, err := ioutil.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := odoh.CreateObliviousDoHConfigs([]odoh.ObliviousDoHConfig{config}).Marshal()
+	if !bytes.Equal(body, expected) {
+		t.Fatal("Received the local configs instead of the key provider's")
+	}
+}
@@ -23,24 +23,20 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/cisco/go-hpke"
-	odoh "github.com/cloudflare/odoh-go"
 )
 
 const (
-	// HPKE constants
-	kemID  = hpke.DHKEM_X25519
-	kdfID  = hpke.KDF_HKDF_SHA256
-	aeadID = hpke.AEAD_AESGCM128
-
 	// keying material (seed) should have as many bits of entropy as the bit
 	// length of the x25519 secret key
 	defaultSeedLength = 32
@@ -54,6 +50,9 @@ const (
 	healthEndpoint = "/health"
 	configEndpoint = "/.well-known/odohconfigs"
 
+	// How long requests in flight may take to complete on shutdown
+	shutdownTimeout = 10 * time.Second
+
 	// Environment variables
 	secretSeedEnvironmentVariable    = "SEED_SECRET_KEY"
 	targetNameEnvironmentVariable    = "TARGET_INSTANCE_NAME"
@@ -61,11 +60,93 @@ const (
 	telemetryTypeEnvironmentVariable = "TELEMETRY_TYPE"
 	certificateEnvironmentVariable   = "CERT"
 	keyEnvironmentVariable           = "KEY"
-)
 
-var (
-	// DNS constants. Fill in a DNS server to forward to here.
-	nameServers = []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"}
+	// Key rotation. The interval enables rotation; the grace period defaults
+	// to the interval.
+	rotationIntervalEnvironmentVariable = "KEY_ROTATION_INTERVAL"
+	rotationGraceEnvironmentVariable    = "KEY_ROTATION_GRACE_PERIOD"
+
+	// Fleet key derivation. When the master secret is set, keys are derived
+	// per epoch and the seed and rotation interval settings are ignored.
+	masterSecretEnvironmentVariable = "MASTER_SECRET_KEY"
+	epochLengthEnvironmentVariable  = "KEY_EPOCH_LENGTH"
+
+	// Directory in which target keys are persisted across restarts
+	keyStoreEnvironmentVariable = "KEYSTORE_DIR"
+
+	// Comma-separated HPKE cipher suites to create keys for
+	cipherSuitesEnvironmentVariable = "ODOH_CIPHER_SUITES"
+
+	// Padding policy for encrypted ODoH responses: none, block:<n> or fixed:<n>
+	responsePaddingEnvironmentVariable = "ODOH_RESPONSE_PADDING"
+
+	// EDNS(0) padding of cleartext DoH responses. Responses are padded when
+	// the query carries a Padding option, or always if DOH_PAD_ALL_RESPONSES
+	// is "true".
+	dohPaddingEnvironmentVariable = "DOH_RESPONSE_PADDING"
+	dohPadAllEnvironmentVariable  = "DOH_PAD_ALL_RESPONSES"
+
+	// Unix socket of an external key provider, e.g. a KMS or HSM bridge, that
+	// decrypts queries instead of the keys held in process
+	keyProviderSocketEnvironmentVariable = "KEY_PROVIDER_SOCKET"
+
+	// Replay detection. The window enables it; the capacity is the number of
+	// queries expected per window.
+	replayWindowEnvironmentVariable   = "ODOH_REPLAY_WINDOW"
+	replayCapacityEnvironmentVariable = "ODOH_REPLAY_CAPACITY"
+
+	// Answer cache. The size is the number of answers held, 0 disabling the
+	// cache; TTLs are clamped between the minimum and maximum.
+	cacheSizeEnvironmentVariable   = "ANSWER_CACHE_SIZE"
+	cacheMinTTLEnvironmentVariable = "ANSWER_CACHE_MIN_TTL"
+	cacheMaxTTLEnvironmentVariable = "ANSWER_CACHE_MAX_TTL"
+
+	// Serving stale answers. The window enables it; the deadline is how long
+	// a query waits for a fresh answer when a stale one is available.
+	cacheStaleWindowEnvironmentVariable   = "ANSWER_CACHE_STALE_WINDOW"
+	cacheStaleDeadlineEnvironmentVariable = "ANSWER_CACHE_STALE_DEADLINE"
+
+	// Prefetching. The rate, in prefetches per second, enables it; answers
+	// are prefetched once hit the minimum number of times.
+	cachePrefetchRateEnvironmentVariable    = "ANSWER_CACHE_PREFETCH_RATE"
+	cachePrefetchMinHitsEnvironmentVariable = "ANSWER_CACHE_PREFETCH_MIN_HITS"
+
+	// File the answer cache is saved to on shutdown and restored from on start
+	cacheFileEnvironmentVariable = "ANSWER_CACHE_FILE"
+
+	// Upstream resolvers, as URLs separated by commas or whitespace, or read
+	// from a file with one URL per line
+	upstreamsEnvironmentVariable     = "UPSTREAMS"
+	upstreamsFileEnvironmentVariable = "UPSTREAMS_FILE"
+
+	// Upstream selection strategy, and the circuit breaker ejecting upstreams
+	// after consecutive failures
+	upstreamStrategyEnvironmentVariable         = "UPSTREAM_STRATEGY"
+	upstreamFailureThresholdEnvironmentVariable = "UPSTREAM_FAILURE_THRESHOLD"
+	upstreamEjectionEnvironmentVariable         = "UPSTREAM_EJECTION_DURATION"
+
+	// Retries on other upstreams: the number of upstreams tried per query and
+	// the deadline for all of them
+	upstreamAttemptsEnvironmentVariable      = "UPSTREAM_ATTEMPTS"
+	upstreamQueryDeadlineEnvironmentVariable = "UPSTREAM_QUERY_DEADLINE"
+
+	// Hedging. The percentile of recent latencies after which a query is also
+	// sent to another upstream enables it; the minimum delay bounds it.
+	upstreamHedgePercentileEnvironmentVariable = "UPSTREAM_HEDGE_PERCENTILE"
+	upstreamHedgeMinDelayEnvironmentVariable   = "UPSTREAM_HEDGE_MIN_DELAY"
+
+	// Name under which the target answers HTTPS queries with its own configs
+	serviceNameEnvironmentVariable = "TARGET_SERVICE_NAME"
+
+	// Admin API. The listener is enabled by ADMIN_PORT and requires ADMIN_TOKEN,
+	// ADMIN_CLIENT_CA or both. TLS uses ADMIN_CERT and ADMIN_KEY, which
+	// default to CERT and KEY.
+	adminPortEnvironmentVariable     = "ADMIN_PORT"
+	adminTokenEnvironmentVariable    = "ADMIN_TOKEN"
+	adminCertEnvironmentVariable     = "ADMIN_CERT"
+	adminKeyEnvironmentVariable      = "ADMIN_KEY"
+	adminClientCAEnvironmentVariable = "ADMIN_CLIENT_CA"
+	adminAuditLogEnvironmentVariable = "ADMIN_AUDIT_LOG"
 )
 
 type odohServer struct {
@@ -90,23 +171,49 @@ func (s odohServer) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "ok")
 }
 
+// durationFromEnvironment parses the duration held in the given environment
+// variable, falling back to defaultValue when it is unset.
+func durationFromEnvironment(name string, defaultValue time.Duration) time.Duration {
+	setting := os.Getenv(name)
+	if setting == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(setting)
+	if err != nil || value < 0 {
+		log.Fatalf("Invalid %s: %v", name, setting)
+	}
+	return value
+}
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = defaultPort
 	}
 
-	var seed []byte
+	// An external key provider holds the keys, so none are created, stored,
+	// rotated or managed in process.
+	keyProviderSocket := os.Getenv(keyProviderSocketEnvironmentVariable)
+	if keyProviderSocket != "" {
+		for _, setting := range []string{secretSeedEnvironmentVariable, masterSecretEnvironmentVariable, rotationIntervalEnvironmentVariable, keyStoreEnvironmentVariable, adminPortEnvironmentVariable} {
+			if os.Getenv(setting) != "" {
+				log.Fatalf("%s cannot be set along with %s", setting, keyProviderSocketEnvironmentVariable)
+			}
+		}
+	}
+
+	// SEED_SECRET_KEY may carry several comma-separated seeds, in which case
+	// the target publishes and accepts a config for each of them.
+	var seeds [][]byte
 	if seedHex := os.Getenv(secretSeedEnvironmentVariable); seedHex != "" {
 		log.Printf("Using Secret Key Seed : [%v]", seedHex)
-		var err error
-		seed, err = hex.DecodeString(seedHex)
-		if err != nil {
-			panic(err)
+		for _, encodedSeed := range strings.Split(seedHex, ",") {
+			seed, err := hex.DecodeString(strings.TrimSpace(encodedSeed))
+			if err != nil {
+				panic(err)
+			}
+			seeds = append(seeds, seed)
 		}
-	} else {
-		seed = make([]byte, defaultSeedLength)
-		rand.Read(seed)
 	}
 
 	var serverName string
@@ -139,10 +246,157 @@ func main() {
 		enableTLSServe = false
 	}
 
-	keyPair, err := odoh.CreateKeyPairFromSeed(kemID, kdfID, aeadID, seed)
-	if err != nil {
-		log.Fatal("Failed to create a private key. Exiting now.")
+	telemetryClient := getTelemetryInstance(telemetryType)
+
+	suites := []cipherSuite{defaultCipherSuite}
+	if suitesSetting := os.Getenv(cipherSuitesEnvironmentVariable); suitesSetting != "" {
+		var err error
+		if suites, err = parseCipherSuites(suitesSetting); err != nil {
+			log.Fatalf("Invalid %s: %v", cipherSuitesEnvironmentVariable, err)
+		}
 	}
+	var keys *targetKeySet
+	if keyProviderSocket == "" {
+		log.Printf("Creating ODoH keys for cipher suites %v", suites)
+
+		keys = newTargetKeySet()
+		if keyStoreDirectory := os.Getenv(keyStoreEnvironmentVariable); keyStoreDirectory != "" {
+			store, err := openKeyStore(keyStoreDirectory)
+			if err != nil {
+				log.Fatalf("Failed to open the keystore: %v", err)
+			}
+			storedKeys, err := store.load()
+			if err != nil {
+				log.Fatalf("Failed to load the keystore: %v", err)
+			}
+			for _, key := range storedKeys {
+				keys.restore(key)
+			}
+			keys.store = store
+			log.Printf("Loaded %d ODoH keys from %v", len(storedKeys), keyStoreDirectory)
+		}
+
+		rotator := &keyRotator{
+			keys:               keys,
+			suites:             suites,
+			generate:           cipherSuite.generateKeyPair,
+			telemetryClient:    telemetryClient,
+			serverInstanceName: serverName,
+			experimentId:       experimentID,
+		}
+		rotating := false
+
+		if masterSecretHex := os.Getenv(masterSecretEnvironmentVariable); masterSecretHex != "" {
+			masterSecret, err := hex.DecodeString(masterSecretHex)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", masterSecretEnvironmentVariable, err)
+			}
+			if os.Getenv(secretSeedEnvironmentVariable) != "" {
+				log.Printf("Ignoring %s in favour of %s", secretSeedEnvironmentVariable, masterSecretEnvironmentVariable)
+			}
+
+			epochLength := durationFromEnvironment(epochLengthEnvironmentVariable, defaultEpochLength)
+			if epochLength <= 0 {
+				log.Fatalf("Invalid %s: must be positive", epochLengthEnvironmentVariable)
+			}
+			rotator.epochs = &epochKeyDeriver{
+				masterSecret: masterSecret,
+				epochLength:  epochLength,
+			}
+			rotator.interval = epochLength
+			rotator.gracePeriod = durationFromEnvironment(rotationGraceEnvironmentVariable, epochLength)
+			log.Printf("Deriving ODoH keys from the master secret with %v epochs and a grace period of %v", epochLength, rotator.gracePeriod)
+
+			if err := rotator.rotateToEpoch(time.Now()); err != nil {
+				log.Fatal("Failed to derive the epoch keys. Exiting now.")
+			}
+			go rotator.run(nil)
+			rotating = true
+		} else {
+			for _, seed := range seeds {
+				for _, suite := range suites {
+					keyPair, err := suite.keyPairFromSeed(seed)
+					if err != nil {
+						log.Fatal("Failed to create a private key. Exiting now.")
+					}
+					keys.add(keyPair)
+				}
+			}
+			if len(keys.configs().Configs) == 0 {
+				for _, suite := range suites {
+					keyPair, err := suite.generateKeyPair()
+					if err != nil {
+						log.Fatal("Failed to create a private key. Exiting now.")
+					}
+					keys.add(keyPair)
+				}
+			}
+
+			if interval := durationFromEnvironment(rotationIntervalEnvironmentVariable, 0); interval > 0 {
+				rotator.interval = interval
+				rotator.gracePeriod = durationFromEnvironment(rotationGraceEnvironmentVariable, interval)
+				log.Printf("Rotating ODoH keys every %v with a grace period of %v", interval, rotator.gracePeriod)
+				rotator.lastRotation = keys.lastActivation()
+				go rotator.run(nil)
+				rotating = true
+			}
+		}
+		if !rotating && (keys.store != nil || os.Getenv(adminPortEnvironmentVariable) != "") {
+			go reportEvery(minimumRotationCheckInterval, nil, rotator.expire)
+		}
+
+		if adminPort := os.Getenv(adminPortEnvironmentVariable); adminPort != "" {
+			auditWriter := log.Writer()
+			if auditPath := os.Getenv(adminAuditLogEnvironmentVariable); auditPath != "" {
+				auditFile, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+				if err != nil {
+					log.Fatalf("Failed to open the audit log: %v", err)
+				}
+				auditWriter = auditFile
+			}
+
+			adminCertFile, adminKeyFile := os.Getenv(adminCertEnvironmentVariable), os.Getenv(adminKeyEnvironmentVariable)
+			if adminCertFile == "" && adminKeyFile == "" && enableTLSServe {
+				adminCertFile, adminKeyFile = certFile, keyFile
+			}
+
+			admin := &adminServer{
+				keys:        keys,
+				suites:      suites,
+				generate:    cipherSuite.generateKeyPair,
+				gracePeriod: rotator.gracePeriod,
+				token:       os.Getenv(adminTokenEnvironmentVariable),
+				audit: &auditLog{
+					writer:             auditWriter,
+					telemetryClient:    telemetryClient,
+					serverInstanceName: serverName,
+					experimentId:       experimentID,
+				},
+			}
+			go func() {
+				log.Fatal(admin.serve(fmt.Sprintf(":%s", adminPort), adminCertFile, adminKeyFile, os.Getenv(adminClientCAEnvironmentVariable)))
+			}()
+		}
+	}
+
+	responsePadding := defaultResponsePadding
+	if paddingSetting := os.Getenv(responsePaddingEnvironmentVariable); paddingSetting != "" {
+		var err error
+		if responsePadding, err = parsePaddingPolicy(paddingSetting); err != nil {
+			log.Fatalf("Invalid %s: %v", responsePaddingEnvironmentVariable, err)
+		}
+	}
+	log.Printf("Padding ODoH responses with policy %v", responsePadding)
+
+	dohPadding := defaultResponsePadding
+	if paddingSetting := os.Getenv(dohPaddingEnvironmentVariable); paddingSetting != "" {
+		var err error
+		if dohPadding, err = parsePaddingPolicy(paddingSetting); err != nil {
+			log.Fatalf("Invalid %s: %v", dohPaddingEnvironmentVariable, err)
+		}
+	}
+	dohPadAll := os.Getenv(dohPadAllEnvironmentVariable) == "true"
+	log.Printf("Padding DoH responses with policy %v (all responses: %v)", dohPadding, dohPadAll)
 
 	endpoints := make(map[string]string)
 	endpoints["Target"] = queryEndpoint
@@ -150,25 +404,137 @@ func main() {
 	endpoints["Health"] = healthEndpoint
 	endpoints["Config"] = configEndpoint
 
-	resolversInUse := make([]resolver, len(nameServers))
-
-	for index := 0; index < len(nameServers); index++ {
-		resolver := &targetResolver{
-			timeout:    2500 * time.Millisecond,
-			nameserver: nameServers[index],
+	var upstreams []upstream
+	var err error
+	if upstreamsFile := os.Getenv(upstreamsFileEnvironmentVariable); upstreamsFile != "" {
+		upstreams, err = loadUpstreams(upstreamsFile)
+	} else if upstreamsSetting := os.Getenv(upstreamsEnvironmentVariable); upstreamsSetting != "" {
+		upstreams, err = parseUpstreams(upstreamsSetting)
+	} else {
+		upstreams, err = parseUpstreams(defaultUpstreams)
+	}
+	if err != nil {
+		log.Fatalf("Invalid upstreams: %v", err)
+	}
+	for _, u := range upstreams {
+		log.Printf("Forwarding queries to upstream %v with weight %d", u.name(), u.weight)
+	}
+	strategy := strategyWeightedRandom
+	if strategySetting := os.Getenv(upstreamStrategyEnvironmentVariable); strategySetting != "" {
+		if strategy, err = parseSelectionStrategy(strategySetting); err != nil {
+			log.Fatalf("Invalid %s: %v", upstreamStrategyEnvironmentVariable, err)
 		}
-		resolversInUse[index] = resolver
 	}
+	selector := newUpstreamSelector(upstreams, strategy)
+	if thresholdSetting := os.Getenv(upstreamFailureThresholdEnvironmentVariable); thresholdSetting != "" {
+		if selector.failureThreshold, err = strconv.Atoi(thresholdSetting); err != nil || selector.failureThreshold <= 0 {
+			log.Fatalf("Invalid %s: %v", upstreamFailureThresholdEnvironmentVariable, thresholdSetting)
+		}
+	}
+	selector.ejectionDuration = durationFromEnvironment(upstreamEjectionEnvironmentVariable, defaultEjectionDuration)
+	if attemptsSetting := os.Getenv(upstreamAttemptsEnvironmentVariable); attemptsSetting != "" {
+		if selector.maxAttempts, err = strconv.Atoi(attemptsSetting); err != nil || selector.maxAttempts <= 0 {
+			log.Fatalf("Invalid %s: %v", upstreamAttemptsEnvironmentVariable, attemptsSetting)
+		}
+	}
+	selector.queryDeadline = durationFromEnvironment(upstreamQueryDeadlineEnvironmentVariable, defaultQueryDeadline)
+	if percentileSetting := os.Getenv(upstreamHedgePercentileEnvironmentVariable); percentileSetting != "" {
+		if selector.hedgePercentile, err = parseHedgePercentile(percentileSetting); err != nil {
+			log.Fatalf("Invalid %s: %v", upstreamHedgePercentileEnvironmentVariable, err)
+		}
+		selector.hedgeMinDelay = durationFromEnvironment(upstreamHedgeMinDelayEnvironmentVariable, defaultHedgeMinDelay)
+		log.Printf("Hedging queries slower than the %vth percentile of upstream latencies", selector.hedgePercentile)
+	}
+	log.Printf("Choosing upstreams with the %v strategy", strategy)
 
 	target := &targetServer{
 		verbose:            false,
-		resolver:           resolversInUse,
-		odohKeyPair:        keyPair,
-		telemetryClient:    getTelemetryInstance(telemetryType),
+		upstreams:          selector,
+		odohKeys:           keys,
+		responsePadding:    responsePadding,
+		dohPadding:         dohPadding,
+		dohPadAll:          dohPadAll,
+		serviceName:        os.Getenv(serviceNameEnvironmentVariable),
+		telemetryClient:    telemetryClient,
 		serverInstanceName: serverName,
 		experimentId:       experimentID,
 	}
 
+	if keyProviderSocket != "" {
+		target.keyProvider = &socketKeyProvider{
+			path:    keyProviderSocket,
+			timeout: defaultKeyProviderTimeout,
+		}
+		log.Printf("Decrypting ODoH queries with the key provider at %v", keyProviderSocket)
+	}
+
+	if replayWindow := durationFromEnvironment(replayWindowEnvironmentVariable, 0); replayWindow > 0 {
+		replayCapacity := defaultReplayCapacity
+		if capacitySetting := os.Getenv(replayCapacityEnvironmentVariable); capacitySetting != "" {
+			var err error
+			if replayCapacity, err = strconv.Atoi(capacitySetting); err != nil || replayCapacity <= 0 {
+				log.Fatalf("Invalid %s: %v", replayCapacityEnvironmentVariable, capacitySetting)
+			}
+		}
+		target.replayGuard = newReplayGuard(replayWindow, replayCapacity, time.Now())
+		target.replayGuard.telemetryClient = telemetryClient
+		target.replayGuard.serverInstanceName = serverName
+		target.replayGuard.experimentId = experimentID
+		log.Printf("Rejecting replayed ODoH queries within %v windows of %d queries", replayWindow, replayCapacity)
+	}
+
+	target.coalescer = newQueryCoalescer()
+	target.coalescer.telemetryClient = telemetryClient
+	target.coalescer.serverInstanceName = serverName
+	target.coalescer.experimentId = experimentID
+	go reportEvery(counterReportInterval, nil, target.coalescer.report)
+
+	cacheSize := defaultCacheSize
+	if sizeSetting := os.Getenv(cacheSizeEnvironmentVariable); sizeSetting != "" {
+		if cacheSize, err = strconv.Atoi(sizeSetting); err != nil || cacheSize < 0 {
+			log.Fatalf("Invalid %s: %v", cacheSizeEnvironmentVariable, sizeSetting)
+		}
+	}
+	if cacheSize > 0 {
+		minTTL := durationFromEnvironment(cacheMinTTLEnvironmentVariable, 0)
+		maxTTL := durationFromEnvironment(cacheMaxTTLEnvironmentVariable, defaultCacheMaxTTL)
+		if minTTL > maxTTL {
+			log.Fatalf("%s exceeds %s", cacheMinTTLEnvironmentVariable, cacheMaxTTLEnvironmentVariable)
+		}
+		target.cache = newAnswerCache(cacheSize, minTTL, maxTTL)
+		target.cache.staleWindow = durationFromEnvironment(cacheStaleWindowEnvironmentVariable, 0)
+		target.cache.staleDeadline = durationFromEnvironment(cacheStaleDeadlineEnvironmentVariable, defaultStaleDeadline)
+		if rateSetting := os.Getenv(cachePrefetchRateEnvironmentVariable); rateSetting != "" {
+			rate, err := strconv.ParseFloat(rateSetting, 64)
+			if err != nil || rate <= 0 {
+				log.Fatalf("Invalid %s: %v", cachePrefetchRateEnvironmentVariable, rateSetting)
+			}
+			target.cache.prefetchMinHits = defaultPrefetchMinHits
+			if hitsSetting := os.Getenv(cachePrefetchMinHitsEnvironmentVariable); hitsSetting != "" {
+				if target.cache.prefetchMinHits, err = strconv.Atoi(hitsSetting); err != nil || target.cache.prefetchMinHits <= 0 {
+					log.Fatalf("Invalid %s: %v", cachePrefetchMinHitsEnvironmentVariable, hitsSetting)
+				}
+			}
+			target.cache.prefetch = target.prefetch
+			target.cache.prefetchLimiter = newTokenBucket(rate, time.Now())
+			log.Printf("Prefetching popular answers, up to %v per second", rate)
+		}
+		target.cache.telemetryClient = telemetryClient
+		target.cache.serverInstanceName = serverName
+		target.cache.experimentId = experimentID
+		go reportEvery(counterReportInterval, nil, target.cache.report)
+		log.Printf("Caching up to %d answers", cacheSize)
+
+		if cacheFile := os.Getenv(cacheFileEnvironmentVariable); cacheFile != "" {
+			restored, err := target.cache.load(cacheFile, time.Now())
+			if err != nil {
+				log.Printf("Failed restoring the answer cache from %s: %v", cacheFile, err)
+			} else {
+				log.Printf("Restored %d answers from %s", restored, cacheFile)
+			}
+		}
+	}
+
 	proxy := &proxyServer{
 		client: &http.Client{
 			Transport: &http.Transport{
@@ -191,12 +557,40 @@ func main() {
 	http.HandleFunc(configEndpoint, target.configHandler)
 	http.HandleFunc("/", server.indexHandler)
 
+	// On SIGINT or SIGTERM, stop accepting requests and let those in flight
+	// complete before exiting.
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%s", port)}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Failed shutting down gracefully: %v", err)
+		}
+		close(stopped)
+	}()
+
 	if enableTLSServe {
 		log.Printf("Listening on port %v with cert %v and key %v\n", port, certFile, keyFile)
-		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%s", port), certFile, keyFile, nil))
+		err = httpServer.ListenAndServeTLS(certFile, keyFile)
 	} else {
 		log.Printf("Listening on port %v without enabling TLS\n", port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-stopped
 
+	if cacheFile := os.Getenv(cacheFileEnvironmentVariable); cacheFile != "" && target.cache != nil {
+		saved, err := target.cache.save(cacheFile, time.Now())
+		if err != nil {
+			log.Fatalf("Failed saving the answer cache to %s: %v", cacheFile, err)
+		}
+		log.Printf("Saved %d answers to %s", saved, cacheFile)
+	}
 }
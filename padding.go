@@ -0,0 +1,174 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Block length recommended for responses by RFC 8467, section 4.1
+	defaultResponsePaddingBlockLength = 468
+
+	// Largest message plus padding an ODoH message body can carry
+	maxPaddedLength = 65535
+)
+
+type paddingMode int
+
+const (
+	paddingNone paddingMode = iota
+	// Pad to the next multiple of the block length.
+	paddingBlock
+	// Pad every message to the same fixed length. Messages that do not fit
+	// are padded to a multiple of it instead.
+	paddingFixed
+)
+
+// paddingPolicy decides how much padding hides the length of a message.
+// Policies are written as "none", "block:<length>" or "fixed:<length>".
+type paddingPolicy struct {
+	mode   paddingMode
+	length int
+}
+
+var defaultResponsePadding = paddingPolicy{
+	mode:   paddingBlock,
+	length: defaultResponsePaddingBlockLength,
+}
+
+func parsePaddingPolicy(setting string) (paddingPolicy, error) {
+	if setting == "none" {
+		return paddingPolicy{mode: paddingNone}, nil
+	}
+
+	parts := strings.SplitN(setting, ":", 2)
+	if len(parts) != 2 {
+		return paddingPolicy{}, fmt.Errorf("invalid padding policy %q", setting)
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil || length <= 0 || length > maxPaddedLength {
+		return paddingPolicy{}, fmt.Errorf("invalid padding length %q", parts[1])
+	}
+
+	switch parts[0] {
+	case "block":
+		return paddingPolicy{mode: paddingBlock, length: length}, nil
+	case "fixed":
+		return paddingPolicy{mode: paddingFixed, length: length}, nil
+	default:
+		return paddingPolicy{}, fmt.Errorf("unknown padding mode %q", parts[0])
+	}
+}
+
+func (p paddingPolicy) String() string {
+	switch p.mode {
+	case paddingBlock:
+		return fmt.Sprintf("block:%d", p.length)
+	case paddingFixed:
+		return fmt.Sprintf("fixed:%d", p.length)
+	default:
+		return "none"
+	}
+}
+
+// paddedLength returns the length a message of messageLength bytes should be
+// padded to.
+func (p paddingPolicy) paddedLength(messageLength int) int {
+	var padded int
+	switch p.mode {
+	case paddingBlock, paddingFixed:
+		if p.mode == paddingFixed && messageLength <= p.length {
+			padded = p.length
+		} else {
+			padded = (messageLength + p.length - 1) / p.length * p.length
+		}
+	default:
+		padded = messageLength
+	}
+
+	if padded > maxPaddedLength {
+		padded = maxPaddedLength
+	}
+	if padded < messageLength {
+		padded = messageLength
+	}
+	return padded
+}
+
+// paddingLength returns the number of padding bytes to add to a message of
+// messageLength bytes.
+func (p paddingPolicy) paddingLength(messageLength int) int {
+	return p.paddedLength(messageLength) - messageLength
+}
+
+// hasPaddingOption reports whether msg carries an EDNS(0) Padding option.
+func hasPaddingOption(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// padDNSMessage sizes an EDNS(0) Padding option (RFC 7830) so that the packed
+// message length follows the policy, adding an OPT record if msg has none.
+// Any existing Padding option is replaced.
+func padDNSMessage(msg *dns.Msg, policy paddingPolicy) ([]byte, error) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			options = append(options, option)
+		}
+	}
+	padding := &dns.EDNS0_PADDING{Padding: []byte{}}
+	opt.Option = append(options, padding)
+
+	msg.Compress = true
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	paddingLength := policy.paddingLength(len(packed))
+	if paddingLength == 0 {
+		return packed, nil
+	}
+
+	padding.Padding = make([]byte, paddingLength)
+	return msg.Pack()
+}
@@ -0,0 +1,245 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+)
+
+// Bytes an AES-128-GCM ODoH response adds around the padded DNS message: two
+// length prefixes and the AEAD tag.
+const odohResponseOverhead = 2 + 2 + 16
+
+// createSizedResolver returns a resolver answering one query per entry of
+// answerCounts, with that many A records in the answer.
+func createSizedResolver(t *testing.T, answerCounts []int) *localResolver {
+	resolver := &localResolver{
+		queries:          make([]string, 0),
+		queryResponseMap: make(map[string][]byte),
+	}
+	for _, count := range answerCounts {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("n%d.example.com.", count), dns.TypeA)
+		packedQuery, err := q.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for i := 0; i < count; i++ {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		packedResponse, err := r.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resolver.queries = append(resolver.queries, string(packedQuery))
+		resolver.queryResponseMap[string(packedQuery)] = packedResponse
+	}
+	return resolver
+}
+
+func TestPaddingPolicy(t *testing.T) {
+	block, err := parsePaddingPolicy("block:128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := parsePaddingPolicy("fixed:512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := parsePaddingPolicy("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		policy   paddingPolicy
+		length   int
+		expected int
+	}{
+		{block, 1, 128},
+		{block, 128, 128},
+		{block, 129, 256},
+		{fixed, 1, 512},
+		{fixed, 512, 512},
+		{fixed, 513, 1024},
+		{none, 77, 77},
+		{block, 65530, 65535},
+	}
+	for _, c := range cases {
+		if padded := c.policy.paddedLength(c.length); padded != c.expected {
+			t.Fatalf("%v padded %d bytes to %d, expected %d", c.policy, c.length, padded, c.expected)
+		}
+	}
+
+	for _, setting := range []string{"", "block", "block:0", "block:-1", "stripe:16", "fixed:70000"} {
+		if _, err := parsePaddingPolicy(setting); err == nil {
+			t.Fatalf("Accepted invalid padding policy %q", setting)
+		}
+	}
+}
+
+func TestQueryHandlerODoHResponsePadding(t *testing.T) {
+	answerCounts := []int{0, 1, 2, 5, 9, 14, 20}
+	r := createSizedResolver(t, answerCounts)
+
+	for _, setting := range []string{"block:128", "fixed:1024"} {
+		policy, err := parsePaddingPolicy(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := createTarget(t, r)
+		target.responsePadding = policy
+		handler := http.HandlerFunc(target.targetQueryHandler)
+		config := target.odohKeys.configs().Configs[0]
+
+		sizes := make(map[int]bool)
+		for _, q := range r.queries {
+			obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
+			encryptedQuery, context, err := config.Contents.EncryptQuery(obliviousQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(encryptedQuery.Marshal()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Add("Content-Type", odohMessageContentType)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+			if status := rr.Result().StatusCode; status != http.StatusOK {
+				t.Fatalf("Result did not yield %d, got %d instead", http.StatusOK, status)
+			}
+
+			responseBody, err := ioutil.ReadAll(rr.Result().Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			odohResponse, err := odoh.UnmarshalDNSMessage(responseBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := context.OpenAnswer(odohResponse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(response, r.queryResponseMap[q]) {
+				t.Fatal("Incorrect response received")
+			}
+
+			paddedLength := len(odohResponse.EncryptedMessage) - odohResponseOverhead
+			if paddedLength%policy.length != 0 {
+				t.Fatalf("%v: %d byte response padded to %d bytes", policy, len(response), paddedLength)
+			}
+			sizes[paddedLength] = true
+		}
+
+		if policy.mode == paddingFixed && len(sizes) != 1 {
+			t.Fatalf("%v: responses have %d distinct sizes", policy, len(sizes))
+		}
+		if policy.mode == paddingBlock && len(sizes) >= len(answerCounts) {
+			t.Fatalf("%v: every response has a distinct size", policy)
+		}
+	}
+}
+
+func sendDoHQuery(t *testing.T, target *targetServer, query []byte) ([]byte, *dns.Msg) {
+	request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", dnsMessageContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.targetQueryHandler).ServeHTTP(rr, request)
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusOK, status)
+	}
+
+	responseBody, err := ioutil.ReadAll(rr.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &dns.Msg{}
+	if err := response.Unpack(responseBody); err != nil {
+		t.Fatal(err)
+	}
+	return responseBody, response
+}
+
+func TestQueryHandlerDoHResponsePadding(t *testing.T) {
+	r := createSizedResolver(t, []int{3})
+	plainQuery := r.queries[0]
+
+	q := &dns.Msg{}
+	if err := q.Unpack([]byte(plainQuery)); err != nil {
+		t.Fatal(err)
+	}
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 8)})
+	paddedQuery, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.queryResponseMap[string(paddedQuery)] = r.queryResponseMap[plainQuery]
+
+	target := createTarget(t, r)
+	target.dohPadding = paddingPolicy{mode: paddingBlock, length: 128}
+
+	packed, response := sendDoHQuery(t, &target, paddedQuery)
+	if !hasPaddingOption(response) || len(packed)%128 != 0 {
+		t.Fatalf("Response to a padded query was not padded: %d bytes", len(packed))
+	}
+	if len(response.Answer) != 3 {
+		t.Fatalf("Padded response lost its answers: %v", response)
+	}
+
+	packed, response = sendDoHQuery(t, &target, []byte(plainQuery))
+	if hasPaddingOption(response) || !bytes.Equal(packed, r.queryResponseMap[plainQuery]) {
+		t.Fatal("Response to an unpadded query was modified")
+	}
+
+	target.dohPadAll = true
+	packed, response = sendDoHQuery(t, &target, []byte(plainQuery))
+	if !hasPaddingOption(response) || len(packed)%128 != 0 {
+		t.Fatalf("Response was not padded although padding is forced: %d bytes", len(packed))
+	}
+}
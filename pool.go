@@ -0,0 +1,382 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultTCPConnections = 4
+	maxPipelinedQueries   = 64
+
+	// How long an idle connection is kept open until the nameserver sends an
+	// edns-tcp-keepalive timeout of its own
+	defaultTCPIdleTimeout = 10 * time.Second
+)
+
+var (
+	errConnectionClosed = errors.New("upstream connection closed")
+	errUpstreamTimeout  = errors.New("upstream timed out")
+)
+
+// tcpPool keeps connections to a nameserver open and pipelines queries over
+// them, matching responses to queries by message ID as RFC 7766 allows. A new
+// connection is dialed when every open one already carries queries, up to
+// maxConnections.
+type tcpPool struct {
+	sync.Mutex
+	dial           func() (net.Conn, error)
+	timeout        time.Duration
+	maxConnections int
+	connections    []*pipelinedConn
+	dialing        int
+	dialed         chan struct{}
+}
+
+func newTCPPool(dial func() (net.Conn, error), timeout time.Duration, maxConnections int) *tcpPool {
+	return &tcpPool{
+		dial:           dial,
+		timeout:        timeout,
+		maxConnections: maxConnections,
+		dialed:         make(chan struct{}),
+	}
+}
+
+// acquire returns the least loaded open connection, or a new one if that
+// connection is busy and the pool has room. It reports whether the connection
+// was reused. When the pool is full of connections still being dialed, it
+// waits for them.
+func (p *tcpPool) acquire() (*pipelinedConn, bool, error) {
+	for {
+		p.Lock()
+		open := p.connections[:0]
+		var best *pipelinedConn
+		bestLoad := 0
+		for _, connection := range p.connections {
+			load, usable := connection.load()
+			if load < 0 {
+				continue
+			}
+			open = append(open, connection)
+			if usable && (best == nil || load < bestLoad) {
+				best, bestLoad = connection, load
+			}
+		}
+		p.connections = open
+
+		full := len(p.connections)+p.dialing >= p.maxConnections
+		if best != nil && (bestLoad == 0 || (full && (bestLoad < maxPipelinedQueries || p.dialing == 0))) {
+			p.Unlock()
+			return best, true, nil
+		}
+		if full && p.dialing > 0 {
+			dialed := p.dialed
+			p.Unlock()
+			<-dialed
+			continue
+		}
+		p.dialing++
+		p.Unlock()
+
+		connection, err := p.connect()
+		if err != nil && best != nil {
+			return best, true, nil
+		}
+		return connection, false, err
+	}
+}
+
+// connect dials a connection counted in dialing, and wakes up the queries
+// waiting for it.
+func (p *tcpPool) connect() (*pipelinedConn, error) {
+	conn, err := p.dial()
+
+	p.Lock()
+	defer p.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	connection := newPipelinedConn(conn)
+	p.connections = append(p.connections, connection)
+	return connection, nil
+}
+
+// exchange sends query over a pooled connection. If a reused connection turns
+// out to have been closed, e.g. by the nameserver while it was idle, the query
+// is sent again over a new one.
+func (p *tcpPool) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	connection, reused, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	response, err := connection.exchange(ctx, query, p.timeout)
+	if reused && errors.Is(err, errConnectionClosed) {
+		p.Lock()
+		p.dialing++
+		p.Unlock()
+		if connection, err = p.connect(); err != nil {
+			return nil, err
+		}
+		response, err = connection.exchange(ctx, query, p.timeout)
+	}
+	return response, err
+}
+
+// close shuts every pooled connection.
+func (p *tcpPool) close() {
+	p.Lock()
+	defer p.Unlock()
+	for _, connection := range p.connections {
+		connection.close(errConnectionClosed)
+	}
+	p.connections = nil
+}
+
+// pipelinedConn carries concurrent queries over one connection. A single
+// reader dispatches responses to the queries waiting for them.
+type pipelinedConn struct {
+	sync.Mutex
+	conn         *dns.Conn
+	writeLock    sync.Mutex
+	pending      map[uint16]chan *dns.Msg
+	idleTimeout  time.Duration
+	readDeadline time.Time
+	draining     bool
+	err          error
+}
+
+func newPipelinedConn(conn net.Conn) *pipelinedConn {
+	c := &pipelinedConn{
+		conn:        &dns.Conn{Conn: conn},
+		pending:     make(map[uint16]chan *dns.Msg),
+		idleTimeout: defaultTCPIdleTimeout,
+	}
+	c.extendReadDeadline(time.Now().Add(c.idleTimeout))
+	go c.readLoop()
+	return c
+}
+
+// load returns the number of queries in flight, or -1 once the connection is
+// closed. A connection the nameserver asked to close is not usable for new
+// queries.
+func (c *pipelinedConn) load() (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return -1, false
+	}
+	return len(c.pending), !c.draining
+}
+
+func (c *pipelinedConn) register() (uint16, chan *dns.Msg, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	for {
+		id := dns.Id()
+		if _, ok := c.pending[id]; !ok {
+			responses := make(chan *dns.Msg, 1)
+			c.pending[id] = responses
+			return id, responses, nil
+		}
+	}
+}
+
+func (c *pipelinedConn) unregister(id uint16) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.pending, id)
+}
+
+// extendReadDeadline makes the reader wait at least until deadline.
+func (c *pipelinedConn) extendReadDeadline(deadline time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if deadline.After(c.readDeadline) {
+		c.readDeadline = deadline
+		c.conn.SetReadDeadline(deadline)
+	}
+}
+
+// close fails every pending query with err. It is safe to call several times.
+func (c *pipelinedConn) close(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("%w: %v", errConnectionClosed, err)
+	c.conn.Close()
+	for id, responses := range c.pending {
+		close(responses)
+		delete(c.pending, id)
+	}
+}
+
+func (c *pipelinedConn) closeError() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+func (c *pipelinedConn) readLoop() {
+	for {
+		response, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.Lock()
+		if timeout, ok := keepaliveTimeout(response); ok {
+			c.idleTimeout = timeout
+			c.draining = timeout == 0
+		}
+		if responses, ok := c.pending[response.Id]; ok {
+			delete(c.pending, response.Id)
+			responses <- response
+		}
+		idle := len(c.pending) == 0
+		if idle {
+			c.readDeadline = time.Now().Add(c.idleTimeout)
+			c.conn.SetReadDeadline(c.readDeadline)
+		}
+		draining := c.draining
+		c.Unlock()
+
+		if idle && draining {
+			c.close(errors.New("closed at the nameserver's request"))
+			return
+		}
+	}
+}
+
+func (c *pipelinedConn) exchange(ctx context.Context, query *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	upstreamQuery := query.Copy()
+	addKeepalive(upstreamQuery)
+	id, responses, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+	upstreamQuery.Id = id
+
+	deadline := time.Now().Add(timeout)
+	c.extendReadDeadline(deadline)
+	c.writeLock.Lock()
+	c.conn.SetWriteDeadline(deadline)
+	err = c.conn.WriteMsg(upstreamQuery)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, fmt.Errorf("%w: %v", errConnectionClosed, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-responses:
+		if !ok {
+			return nil, c.closeError()
+		}
+		if !matchesQuestion(upstreamQuery, response) {
+			return nil, fmt.Errorf("upstream answered a different question")
+		}
+		response.Id = query.Id
+		if query.IsEdns0() == nil {
+			removeOPT(response)
+		} else {
+			removeKeepalive(response)
+		}
+		return response, nil
+	case <-timer.C:
+		return nil, errUpstreamTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// The edns-tcp-keepalive option is handled as a local option:
+// dns.EDNS0_TCP_KEEPALIVE does not survive a round trip in this version of
+// miekg/dns.
+
+// addKeepalive asks the nameserver for its idle timeout (RFC 7828). An
+// edns-tcp-keepalive option the query already carries is replaced, as a query
+// may carry only one, without a timeout.
+func addKeepalive(query *dns.Msg) {
+	opt := query.IsEdns0()
+	if opt == nil {
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		opt = query.IsEdns0()
+	}
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, option)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+}
+
+// keepaliveTimeout returns the idle timeout a nameserver sent in its
+// edns-tcp-keepalive option.
+func keepaliveTimeout(response *dns.Msg) (time.Duration, bool) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == dns.EDNS0TCPKEEPALIVE && len(local.Data) == 2 {
+			return time.Duration(binary.BigEndian.Uint16(local.Data)) * 100 * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
+
+func removeKeepalive(response *dns.Msg) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
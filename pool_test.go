@@ -0,0 +1,264 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTCPServer hands every accepted connection to serve, and counts them.
+func startTCPServer(t *testing.T, serve func(conn *dns.Conn)) (string, *int32, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveListener(listener, serve)
+}
+
+func serveListener(listener net.Listener, serve func(conn *dns.Conn)) (string, *int32, func()) {
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				defer conn.Close()
+				serve(&dns.Conn{Conn: conn})
+			}()
+		}
+	}()
+	return listener.Addr().String(), accepted, func() { listener.Close() }
+}
+
+// answerAll answers every query on conn until it is closed.
+func answerAll(conn *dns.Conn) {
+	for {
+		query, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.WriteMsg(answerA(query, "192.0.2.1"))
+	}
+}
+
+func createPooledResolver(address string, connections int) targetResolver {
+	return newTargetResolver(address, time.Second, connections)
+}
+
+// resolveName fails the test unless r answers a query for name. It may be
+// called from several goroutines.
+func resolveName(t *testing.T, r resolver, name string) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	response, err := r.resolve(context.Background(), query)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	if response.Id != query.Id || response.Question[0].Name != name {
+		t.Errorf("Response %v does not match query %v", response, query)
+	}
+	return response
+}
+
+func TestTCPPoolReusesConnections(t *testing.T) {
+	address, accepted, shutdown := startTCPServer(t, answerAll)
+	defer shutdown()
+
+	r := createPooledResolver(address, defaultTCPConnections)
+	defer r.pool.close()
+	for i := 0; i < 10; i++ {
+		response := resolveName(t, r, "example.com.")
+		if response != nil && response.IsEdns0() != nil {
+			t.Fatal("Response carries an OPT record the client did not ask for")
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("Expected a single connection, got %d", n)
+	}
+}
+
+func TestTCPPoolPipelinesQueries(t *testing.T) {
+	// The server reads two queries before answering them in reverse order.
+	address, accepted, shutdown := startTCPServer(t, func(conn *dns.Conn) {
+		first, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		second, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.WriteMsg(answerA(second, "192.0.2.2"))
+		conn.WriteMsg(answerA(first, "192.0.2.1"))
+		answerAll(conn)
+	})
+	defer shutdown()
+
+	r := createPooledResolver(address, 1)
+	defer r.pool.close()
+	var wg sync.WaitGroup
+	for _, name := range []string{"one.example.", "two.example."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			resolveName(t, r, name)
+		}(name)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("Expected a single connection, got %d", n)
+	}
+}
+
+func TestTCPPoolHonoursKeepalive(t *testing.T) {
+	// The server asks the client to close the connection after each answer.
+	address, accepted, shutdown := startTCPServer(t, func(conn *dns.Conn) {
+		query, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		opt := query.IsEdns0()
+		if opt == nil {
+			t.Error("Query does not carry an edns-tcp-keepalive option")
+			return
+		}
+		response := answerA(query, "192.0.2.1")
+		response.SetEdns0(dns.DefaultMsgSize, false)
+		response.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{0, 0}}}
+		conn.WriteMsg(response)
+		conn.ReadMsg()
+	})
+	defer shutdown()
+
+	r := createPooledResolver(address, 1)
+	defer r.pool.close()
+	for i := 0; i < 3; i++ {
+		resolveName(t, r, "example.com.")
+	}
+	if n := atomic.LoadInt32(accepted); n != 3 {
+		t.Fatalf("Expected a connection per query, got %d", n)
+	}
+}
+
+func TestTCPPoolReconnects(t *testing.T) {
+	// The server closes every connection after one answer, without notice.
+	address, accepted, shutdown := startTCPServer(t, func(conn *dns.Conn) {
+		query, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.WriteMsg(answerA(query, "192.0.2.1"))
+	})
+	defer shutdown()
+
+	r := createPooledResolver(address, 1)
+	defer r.pool.close()
+	for i := 0; i < 3; i++ {
+		resolveName(t, r, "example.com.")
+	}
+	if n := atomic.LoadInt32(accepted); n != 3 {
+		t.Fatalf("Expected a connection per query, got %d", n)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	response := new(dns.Msg)
+	response.SetEdns0(dns.DefaultMsgSize, false)
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, 25)
+	response.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data}}
+
+	packed, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if timeout, ok := keepaliveTimeout(unpacked); !ok || timeout != 2500*time.Millisecond {
+		t.Fatalf("Unexpected keepalive timeout %v", timeout)
+	}
+}
+
+func TestAddKeepaliveReplacesOption(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.SetEdns0(dns.DefaultMsgSize, false)
+	query.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{0, 1}},
+		&dns.EDNS0_LOCAL{Code: dns.EDNS0PADDING, Data: []byte{0}},
+	}
+	addKeepalive(query)
+
+	keepalives := 0
+	for _, option := range query.IsEdns0().Option {
+		if option.Option() == dns.EDNS0TCPKEEPALIVE {
+			keepalives++
+			if local := option.(*dns.EDNS0_LOCAL); len(local.Data) != 0 {
+				t.Fatal("Query edns-tcp-keepalive option carries a timeout")
+			}
+		}
+	}
+	if keepalives != 1 || len(query.IsEdns0().Option) != 2 {
+		t.Fatalf("Unexpected options %v", query.IsEdns0().Option)
+	}
+}
+
+func TestTCPPoolCancelledQuery(t *testing.T) {
+	address, _, shutdown := startTCPServer(t, func(conn *dns.Conn) {
+		for {
+			if _, err := conn.ReadMsg(); err != nil {
+				return
+			}
+		}
+	})
+	defer shutdown()
+	r := createPooledResolver(address, 1)
+	defer r.pool.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	query := &dns.Msg{}
+	query.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, err := r.resolve(ctx, query); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the context deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Cancelled query took %v", elapsed)
+	}
+}
@@ -0,0 +1,133 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Share of an answer's lifetime, at the end of it, during which hits
+	// trigger a prefetch
+	prefetchThreshold = 0.1
+
+	defaultPrefetchMinHits = 3
+)
+
+// tokenBucket allows rate events per second on average, and bursts of up to
+// rate events.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// query returns a query for the answers held under key.
+func (key cacheKey) query() *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion(key.name, key.qtype)
+	query.Question[0].Qclass = key.qclass
+	if key.do {
+		query.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return query
+}
+
+// claimPrefetch counts a hit on entry, and reports whether it should be
+// prefetched: it is still cached, in the last tenth of its lifetime, hit at
+// least prefetchMinHits times, not being prefetched already, and the rate
+// limit allows it.
+func (c *answerCache) claimPrefetch(entry *cacheEntry, now time.Time) bool {
+	shard := c.shard(entry.key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	entry.hits++
+	if element, ok := shard.entries[entry.key]; !ok || element.Value != entry || entry.prefetching || entry.hits < c.prefetchMinHits {
+		return false
+	}
+	lifetime := entry.expires.Sub(entry.stored)
+	if float64(entry.expires.Sub(now)) > prefetchThreshold*float64(lifetime) {
+		return false
+	}
+	if c.prefetchLimiter != nil && !c.prefetchLimiter.allow(now) {
+		atomic.AddUint64(&c.prefetchesLimited, 1)
+		return false
+	}
+	entry.prefetching = true
+	return true
+}
+
+// runPrefetch refreshes entry. A successful refresh normally replaces the
+// entry, but the new answer may not be cacheable, so the entry is released
+// either way: a later hit may try again.
+func (c *answerCache) runPrefetch(entry *cacheEntry) {
+	atomic.AddUint64(&c.prefetches, 1)
+	if err := c.prefetch(entry.key.query()); err != nil {
+		atomic.AddUint64(&c.prefetchFailures, 1)
+	}
+	shard := c.shard(entry.key)
+	shard.Lock()
+	entry.prefetching = false
+	shard.Unlock()
+}
+
+// prefetch resolves a query on behalf of the cache, bypassing the coalescer
+// so that prefetches are not counted with client queries.
+func (s *targetServer) prefetch(q *dns.Msg) error {
+	r := s.exchangeAndCache(q)
+	if r.err != nil {
+		return r.err
+	}
+	if retryable(r.response) {
+		return fmt.Errorf("upstream answered %s", dns.RcodeToString[r.response.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, now)
+	if !bucket.allow(now) || !bucket.allow(now) {
+		t.Fatal("Burst denied")
+	}
+	if bucket.allow(now) {
+		t.Fatal("Rate exceeded")
+	}
+	if !bucket.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("Refilled token denied")
+	}
+	if bucket.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("Rate exceeded after refill")
+	}
+}
+
+// createPrefetchingCache returns a cache whose prefetches are sent to the
+// returned channel, and fail with err.
+func createPrefetchingCache(err error) (*answerCache, chan *dns.Msg) {
+	prefetched := make(chan *dns.Msg, 10)
+	cache := newAnswerCache(100, 0, time.Hour)
+	cache.prefetchMinHits = 3
+	cache.prefetch = func(query *dns.Msg) error {
+		prefetched <- query
+		return err
+	}
+	return cache, prefetched
+}
+
+func expectPrefetch(t *testing.T, prefetched chan *dns.Msg) *dns.Msg {
+	select {
+	case query := <-prefetched:
+		return query
+	case <-time.After(time.Second):
+		t.Fatal("Answer not prefetched")
+		return nil
+	}
+}
+
+func expectNoPrefetch(t *testing.T, prefetched chan *dns.Msg) {
+	select {
+	case query := <-prefetched:
+		t.Fatalf("Unexpected prefetch of %v", query.Question[0])
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCachePrefetchesPopularAnswers(t *testing.T) {
+	cache, prefetched := createPrefetchingCache(nil)
+	release := make(chan struct{})
+	defer close(release)
+	cache.prefetch = func(query *dns.Msg) error {
+		prefetched <- query
+		<-release
+		return nil
+	}
+	now := time.Now()
+	query := questionFor("Example.COM.")
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+
+	for i := 0; i < 3; i++ {
+		cache.get(query, now.Add(10*time.Second))
+	}
+	expectNoPrefetch(t, prefetched)
+
+	cache.get(query, now.Add(55*time.Second))
+	prefetch := expectPrefetch(t, prefetched)
+	if question := prefetch.Question[0]; question.Name != "example.com." || question.Qtype != dns.TypeA || prefetch.IsEdns0() != nil {
+		t.Fatalf("Unexpected prefetch query %v", prefetch)
+	}
+
+	// A single prefetch is made at a time.
+	cache.get(query, now.Add(56*time.Second))
+	expectNoPrefetch(t, prefetched)
+	if cache.prefetches != 1 {
+		t.Fatalf("Counted %d prefetches", cache.prefetches)
+	}
+}
+
+func TestCachePrefetchesOnlyPopularAnswers(t *testing.T) {
+	cache, prefetched := createPrefetchingCache(nil)
+	now := time.Now()
+	query := questionFor("example.com.")
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+
+	cache.get(query, now.Add(55*time.Second))
+	cache.get(query, now.Add(55*time.Second))
+	expectNoPrefetch(t, prefetched)
+}
+
+func TestCacheRetriesFailedPrefetch(t *testing.T) {
+	cache, prefetched := createPrefetchingCache(errors.New("upstream answered SERVFAIL"))
+	now := time.Now()
+	query := questionFor("example.com.")
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+	for i := 0; i < 3; i++ {
+		cache.get(query, now.Add(55*time.Second))
+	}
+	expectPrefetch(t, prefetched)
+
+	for i := 0; atomic.LoadUint64(&cache.prefetchFailures) == 0; i++ {
+		if i == 100 {
+			t.Fatal("Prefetch failure not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.get(query, now.Add(56*time.Second))
+	expectPrefetch(t, prefetched)
+}
+
+func TestCacheRetriesUncachedPrefetch(t *testing.T) {
+	// The prefetch succeeds, but leaves the entry in place, as when the new
+	// answer cannot be cached.
+	cache, prefetched := createPrefetchingCache(nil)
+	now := time.Now()
+	query := questionFor("example.com.")
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+	for i := 0; i < 3; i++ {
+		cache.get(query, now.Add(55*time.Second))
+	}
+	expectPrefetch(t, prefetched)
+
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("Entry not prefetched again")
+		}
+		cache.get(query, now.Add(56*time.Second))
+		select {
+		case <-prefetched:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestCacheRateLimitsPrefetches(t *testing.T) {
+	cache, prefetched := createPrefetchingCache(nil)
+	now := time.Now()
+	cache.prefetchLimiter = newTokenBucket(1, now)
+	for _, name := range []string{"a.example.", "b.example."} {
+		query := questionFor(name)
+		cache.set(query, answerA(query, "192.0.2.1"), now)
+		for i := 0; i < 3; i++ {
+			cache.get(query, now.Add(55*time.Second))
+		}
+	}
+	expectPrefetch(t, prefetched)
+	expectNoPrefetch(t, prefetched)
+	if cache.prefetchesLimited == 0 {
+		t.Fatal("Limited prefetch not counted")
+	}
+}
+
+func TestTargetPrefetchesAnswers(t *testing.T) {
+	r := &countingResolver{}
+	target := createTarget(t, r)
+	target.coalescer = newQueryCoalescer()
+	target.cache = newAnswerCache(100, 0, time.Hour)
+	target.cache.prefetchMinHits = 1
+	target.cache.prefetch = target.prefetch
+
+	query := questionFor("example.com.")
+	target.cache.set(query, answerA(query, "192.0.2.1"), time.Now().Add(-55*time.Second))
+	if _, exp := resolveForTest(t, &target, query); !exp.CacheHit {
+		t.Fatal("Answer not served from the cache")
+	}
+	for i := 0; ; i++ {
+		if response := target.cache.get(query, time.Now()); response != nil && response.Answer[0].Header().Ttl == 60 {
+			break
+		} else if i == 100 {
+			t.Fatal("Answer not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := atomic.LoadInt32(&r.calls); calls != 1 {
+		t.Fatalf("Upstream queried %d times", calls)
+	}
+	if target.coalescer.exchanges != 0 {
+		t.Fatal("Prefetch counted as a client exchange")
+	}
+}
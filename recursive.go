@@ -0,0 +1,559 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Limits on the work done for a single client query, so that broken or
+	// hostile delegations cannot keep the resolver busy
+	maxRecursiveQueries = 64
+	maxCNAMEChain       = 8
+	maxNameserverDepth  = 4
+	// Number of minimised queries sent for a name before asking for the full
+	// name, as MAX_MINIMISE_COUNT in RFC 9156
+	maxMinimisedQueries = 10
+	// Number of zone cuts remembered between queries
+	maxDelegations = 10000
+)
+
+var (
+	errRecursionLimit = errors.New("recursion limit reached")
+	errNoNameservers  = errors.New("no usable nameserver")
+)
+
+// rootServers are the root hints used unless the hints option names a file,
+// from https://www.internic.net/domain/named.root.
+var rootServers = []struct{ name, ipv4, ipv6 string }{
+	{"a.root-servers.net.", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net.", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net.", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net.", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net.", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net.", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net.", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net.", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net.", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net.", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net.", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net.", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net.", "202.12.27.33", "2001:dc3::35"},
+}
+
+// delegation is a zone along with the addresses of its nameservers.
+type delegation struct {
+	zone    string
+	servers []net.IP
+	expires time.Time
+}
+
+// recursiveResolver resolves queries itself, walking down from the root
+// servers. It minimises the names sent to each server (RFC 9156), follows
+// CNAME chains, and ignores records that a server is not authoritative for.
+// Zone cuts learned along the way are cached until their NS records expire.
+type recursiveResolver struct {
+	roots    delegation
+	timeout  time.Duration
+	minimise bool
+	// address returns the address to query a nameserver at.
+	address func(ip net.IP) string
+
+	sync.Mutex
+	delegations map[string]delegation
+}
+
+func newRecursiveResolver(config upstreamConfig) (resolver, error) {
+	if err := config.checkOptions("hints", "qmin"); err != nil {
+		return nil, err
+	}
+	r := &recursiveResolver{
+		timeout:  config.timeout,
+		minimise: true,
+		address: func(ip net.IP) string {
+			return net.JoinHostPort(ip.String(), defaultDNSPort)
+		},
+		delegations: make(map[string]delegation),
+	}
+	switch qmin := config.options.Get("qmin"); qmin {
+	case "", "true":
+	case "false":
+		r.minimise = false
+	default:
+		return nil, fmt.Errorf("upstream %s: invalid qmin %q", config.name, qmin)
+	}
+
+	r.roots = delegation{zone: "."}
+	if hints := config.options.Get("hints"); hints != "" {
+		servers, err := loadRootHints(hints)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", config.name, err)
+		}
+		r.roots.servers = servers
+	} else {
+		for _, server := range rootServers {
+			r.roots.servers = append(r.roots.servers, net.ParseIP(server.ipv4), net.ParseIP(server.ipv6))
+		}
+	}
+	return r, nil
+}
+
+// loadRootHints reads the addresses of the root servers from a zone file in
+// the format of named.root.
+func loadRootHints(path string) ([]net.IP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	servers := make([]net.IP, 0)
+	parser := dns.NewZoneParser(file, ".", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.A:
+			servers = append(servers, rr.A)
+		case *dns.AAAA:
+			servers = append(servers, rr.AAAA)
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no root server address in %s", path)
+	}
+	return servers, nil
+}
+
+func (r *recursiveResolver) name() string {
+	return "recursive"
+}
+
+// closestDelegation returns the deepest cached zone cut above name, or the
+// root servers.
+func (r *recursiveResolver) closestDelegation(name string, now time.Time) delegation {
+	r.Lock()
+	defer r.Unlock()
+	for _, index := range dns.Split(name) {
+		if d, ok := r.delegations[name[index:]]; ok && now.Before(d.expires) {
+			return d
+		}
+	}
+	return r.roots
+}
+
+func (r *recursiveResolver) storeDelegation(d delegation, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.delegations) >= maxDelegations {
+		for zone, cached := range r.delegations {
+			if !now.Before(cached.expires) {
+				delete(r.delegations, zone)
+			}
+		}
+		if len(r.delegations) >= maxDelegations {
+			return
+		}
+	}
+	r.delegations[d.zone] = d
+}
+
+func (r *recursiveResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	response := new(dns.Msg)
+	if len(query.Question) != 1 {
+		return response.SetRcode(query, dns.RcodeFormatError), nil
+	}
+	question := query.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return response.SetRcode(query, dns.RcodeNotImplemented), nil
+	}
+
+	state := &recursion{resolver: r, ctx: ctx}
+	result, err := state.resolve(strings.ToLower(question.Name), question.Qtype, 0)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		response.SetRcode(query, dns.RcodeServerFailure)
+	} else {
+		response.SetRcode(query, result.rcode)
+		response.Answer = result.answer
+		response.Ns = result.authority
+	}
+	response.RecursionAvailable = true
+	if opt := query.IsEdns0(); opt != nil {
+		response.SetEdns0(defaultUDPBufferSize, opt.Do())
+	}
+	return response, nil
+}
+
+// recursion is the state of the resolution of one client query.
+type recursion struct {
+	resolver *recursiveResolver
+	ctx      context.Context
+	queries  int
+}
+
+type recursionResult struct {
+	rcode     int
+	answer    []dns.RR
+	authority []dns.RR
+}
+
+// resolve looks name up and chases the CNAME records it leads to.
+func (s *recursion) resolve(name string, qtype uint16, depth int) (recursionResult, error) {
+	chain := make([]dns.RR, 0)
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		response, zone, err := s.lookup(name, qtype, depth)
+		if err != nil {
+			return recursionResult{}, err
+		}
+		answer, next := followAnswer(response.Answer, name, qtype, zone)
+		chain = append(chain, answer...)
+		if next == "" || response.Rcode != dns.RcodeSuccess {
+			return recursionResult{
+				rcode:     response.Rcode,
+				answer:    chain,
+				authority: inBailiwick(response.Ns, zone, dns.TypeSOA),
+			}, nil
+		}
+		name = next
+	}
+	return recursionResult{}, fmt.Errorf("%w: CNAME chain longer than %d", errRecursionLimit, maxCNAMEChain)
+}
+
+// lookup walks down the zone cuts to the zone of name and returns the
+// response of its nameservers, along with the zone.
+func (s *recursion) lookup(name string, qtype uint16, depth int) (*dns.Msg, string, error) {
+	current := s.resolver.closestDelegation(name, time.Now())
+	// known is the deepest name under the current zone known not to be a
+	// zone cut.
+	known := current.zone
+	minimise := s.resolver.minimise
+	minimised := 0
+	for {
+		qname, qt := name, qtype
+		if minimise && minimised < maxMinimisedQueries {
+			if child := childName(known, name); child != name {
+				qname, qt = child, dns.TypeA
+			}
+		}
+		response, err := s.query(current, qname, qt)
+		if err != nil {
+			if qname != name && s.ctx.Err() == nil && !errors.Is(err, errRecursionLimit) {
+				// Some servers mishandle names they hold nothing for:
+				// fall back to the full name (RFC 9156, section 3).
+				minimise = false
+				continue
+			}
+			return nil, "", err
+		}
+
+		if cut, ok := referral(response, current.zone, qname); ok {
+			next, err := s.delegation(cut, response, current.zone, depth)
+			if err != nil {
+				return nil, "", err
+			}
+			current, known = next, next.zone
+			continue
+		}
+		if qname == name {
+			return response, current.zone, nil
+		}
+		if response.Rcode == dns.RcodeNameError {
+			// Nothing exists below a name that does not exist (RFC 8020).
+			return response, current.zone, nil
+		}
+		known = qname
+		minimised++
+	}
+}
+
+// query sends a question to the nameservers of a zone in turn until one
+// gives a usable response.
+func (s *recursion) query(d delegation, qname string, qtype uint16) (*dns.Msg, error) {
+	err := fmt.Errorf("%w for %s", errNoNameservers, d.zone)
+	for _, server := range orderServers(d.servers) {
+		if s.queries >= maxRecursiveQueries {
+			return nil, fmt.Errorf("%w: more than %d queries", errRecursionLimit, maxRecursiveQueries)
+		}
+		s.queries++
+
+		var response *dns.Msg
+		response, err = s.exchange(server, qname, qtype)
+		if s.ctx.Err() != nil {
+			return nil, s.ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("nameserver %v of %s answered %s", server, d.zone, dns.RcodeToString[response.Rcode])
+			continue
+		}
+		if isReferral(response) {
+			if _, ok := referral(response, d.zone, qname); !ok {
+				err = fmt.Errorf("nameserver %v of %s sent a lame referral", server, d.zone)
+				continue
+			}
+		}
+		return response, nil
+	}
+	return nil, err
+}
+
+func (s *recursion) exchange(server net.IP, qname string, qtype uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(qname, qtype)
+	query.RecursionDesired = false
+	query.SetEdns0(defaultUDPBufferSize, false)
+
+	address := s.resolver.address(server)
+	response, err := exchangeUDP(s.ctx, address, query, defaultUDPBufferSize, s.resolver.timeout)
+	if err != errTruncated {
+		return response, err
+	}
+	return exchangeTCP(s.ctx, address, query, s.resolver.timeout)
+}
+
+// exchangeTCP sends query to nameserver over a new TCP connection and waits at
+// most timeout for the response. Cancelling ctx interrupts the exchange, which
+// dns.Client.ExchangeContext does not do in this version of miekg/dns.
+func exchangeTCP(ctx context.Context, nameserver string, query *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	connection, err := dialer.DialContext(ctx, "tcp", nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(timeout))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	conn := &dns.Conn{Conn: connection}
+	if err := conn.WriteMsg(query); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	response, err := conn.ReadMsg()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, err
+	}
+	if !matchesQuestion(query, response) {
+		return nil, fmt.Errorf("nameserver answered a different question")
+	}
+	return response, nil
+}
+
+// delegation builds the zone cut a referral points to, from the glue that
+// the parent zone is authoritative for, or else by resolving the names of
+// the nameservers.
+func (s *recursion) delegation(cut string, response *dns.Msg, parent string, depth int) (delegation, error) {
+	now := time.Now()
+	d := delegation{zone: cut}
+	names := make(map[string]bool)
+	nameservers := make([]string, 0)
+	ttl := uint32(0)
+	for _, rr := range response.Ns {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, cut) {
+			name := strings.ToLower(ns.Ns)
+			if !names[name] {
+				names[name] = true
+				nameservers = append(nameservers, name)
+			}
+			if ttl == 0 || ns.Hdr.Ttl < ttl {
+				ttl = ns.Hdr.Ttl
+			}
+		}
+	}
+	for _, rr := range inBailiwick(response.Extra, parent, dns.TypeA, dns.TypeAAAA) {
+		if !names[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			d.servers = append(d.servers, rr.A)
+		case *dns.AAAA:
+			d.servers = append(d.servers, rr.AAAA)
+		}
+	}
+
+	if len(d.servers) == 0 {
+		if depth >= maxNameserverDepth {
+			return delegation{}, fmt.Errorf("%w: nameservers of %s nested too deep", errRecursionLimit, cut)
+		}
+		for _, name := range nameservers {
+			result, err := s.resolve(name, dns.TypeA, depth+1)
+			if s.ctx.Err() != nil || errors.Is(err, errRecursionLimit) {
+				return delegation{}, err
+			}
+			for _, rr := range result.answer {
+				if a, ok := rr.(*dns.A); ok {
+					d.servers = append(d.servers, a.A)
+				}
+			}
+			if len(d.servers) > 0 {
+				break
+			}
+		}
+		if len(d.servers) == 0 {
+			return delegation{}, fmt.Errorf("%w for %s", errNoNameservers, cut)
+		}
+	}
+
+	d.expires = now.Add(time.Duration(ttl) * time.Second)
+	s.resolver.storeDelegation(d, now)
+	return d, nil
+}
+
+// orderServers returns the addresses in random order, IPv4 first.
+func orderServers(servers []net.IP) []net.IP {
+	ordered := make([]net.IP, 0, len(servers))
+	others := make([]net.IP, 0)
+	for _, index := range rand.Perm(len(servers)) {
+		if servers[index].To4() != nil {
+			ordered = append(ordered, servers[index])
+		} else {
+			others = append(others, servers[index])
+		}
+	}
+	return append(ordered, others...)
+}
+
+// childName returns the name one label below parent on the way to name.
+func childName(parent string, name string) string {
+	labels := dns.Split(name)
+	below := len(labels) - dns.CountLabel(parent)
+	if below <= 1 {
+		return name
+	}
+	return name[labels[below-1]:]
+}
+
+// isReferral reports whether a response delegates the question elsewhere
+// rather than answering it.
+func isReferral(response *dns.Msg) bool {
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		return false
+	}
+	for _, rr := range response.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return false
+		}
+	}
+	for _, rr := range response.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+// referral returns the zone cut a response delegates qname to, if the cut
+// lies strictly below zone and at or above qname.
+func referral(response *dns.Msg, zone string, qname string) (string, bool) {
+	if !isReferral(response) {
+		return "", false
+	}
+	for _, rr := range response.Ns {
+		cut := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeNS && cut != zone && dns.IsSubDomain(zone, cut) && dns.IsSubDomain(cut, qname) {
+			return cut, true
+		}
+	}
+	return "", false
+}
+
+// inBailiwick returns the records of the given types that belong to zone.
+func inBailiwick(records []dns.RR, zone string, types ...uint16) []dns.RR {
+	kept := make([]dns.RR, 0)
+	for _, rr := range records {
+		for _, t := range types {
+			if rr.Header().Rrtype == t && dns.IsSubDomain(zone, rr.Header().Name) {
+				kept = append(kept, rr)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// followAnswer returns the records of the answer section that answer name,
+// including the CNAME records leading to them, and the name left to resolve
+// when the chain leaves the answer. Records outside zone are ignored.
+func followAnswer(records []dns.RR, name string, qtype uint16, zone string) ([]dns.RR, string) {
+	answer := make([]dns.RR, 0)
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		var target string
+		found := false
+		for _, rr := range records {
+			header := rr.Header()
+			if !strings.EqualFold(header.Name, name) || !dns.IsSubDomain(zone, header.Name) {
+				continue
+			}
+			if header.Rrtype == qtype || qtype == dns.TypeANY {
+				answer = append(answer, rr)
+				found = true
+			} else if cname, ok := rr.(*dns.CNAME); ok && target == "" {
+				answer = append(answer, rr)
+				target = strings.ToLower(cname.Target)
+			}
+		}
+		if found {
+			return answer, ""
+		}
+		if target == "" {
+			if hops == 0 {
+				return answer, ""
+			}
+			// The chain leads out of the response.
+			return answer, name
+		}
+		name = target
+	}
+	return answer, name
+}
@@ -0,0 +1,401 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is an authoritative server for a zone given as records. It refers
+// queries below its NS records to the child zone, with whatever address
+// records it holds for the nameservers as glue, and follows CNAME records
+// through its own data, in or out of the zone.
+type testZone struct {
+	origin  string
+	records []dns.RR
+
+	sync.Mutex
+	queries []string
+}
+
+func newTestZone(t *testing.T, origin string, records ...string) *testZone {
+	z := &testZone{origin: origin}
+	records = append(records, fmt.Sprintf("%s 3600 IN SOA ns.invalid. hostmaster.invalid. 1 7200 900 1209600 300", origin))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.records = append(z.records, rr)
+	}
+	return z
+}
+
+func (z *testZone) lookup(name string, rrtype uint16) []dns.RR {
+	found := make([]dns.RR, 0)
+	for _, rr := range z.records {
+		if strings.EqualFold(rr.Header().Name, name) && rr.Header().Rrtype == rrtype {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+func (z *testZone) exists(name string) bool {
+	for _, rr := range z.records {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *testZone) received() []string {
+	z.Lock()
+	defer z.Unlock()
+	return append([]string(nil), z.queries...)
+}
+
+func (z *testZone) serveDNS(w dns.ResponseWriter, query *dns.Msg) {
+	question := query.Question[0]
+	name := strings.ToLower(question.Name)
+	z.Lock()
+	z.queries = append(z.queries, name)
+	z.Unlock()
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	for _, rr := range z.records {
+		if rr.Header().Rrtype == dns.TypeNS && rr.Header().Name != z.origin && dns.IsSubDomain(rr.Header().Name, name) {
+			response.Ns = z.lookup(rr.Header().Name, dns.TypeNS)
+			for _, ns := range response.Ns {
+				response.Extra = append(response.Extra, z.lookup(ns.(*dns.NS).Ns, dns.TypeA)...)
+			}
+			w.WriteMsg(response)
+			return
+		}
+	}
+
+	response.Authoritative = true
+	for hops := 0; hops < maxCNAMEChain; hops++ {
+		if answer := z.lookup(name, question.Qtype); len(answer) > 0 {
+			response.Answer = append(response.Answer, answer...)
+			w.WriteMsg(response)
+			return
+		}
+		cname := z.lookup(name, dns.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		response.Answer = append(response.Answer, cname...)
+		name = cname[0].(*dns.CNAME).Target
+	}
+	if len(response.Answer) == 0 && !z.exists(name) {
+		response.Rcode = dns.RcodeNameError
+	}
+	response.Ns = z.lookup(z.origin, dns.TypeSOA)
+	w.WriteMsg(response)
+}
+
+// testNetwork is a delegation tree of test zones, each served at an address
+// of 192.0.2.0/24 mapped to a local port.
+type testNetwork struct {
+	root, example, sub, other, victim, attacker *testZone
+	addresses                                   map[string]string
+	shutdown                                    []func()
+}
+
+func startTestNetwork(t *testing.T) *testNetwork {
+	n := &testNetwork{addresses: make(map[string]string)}
+	n.root = newTestZone(t, ".",
+		"example. 3600 IN NS ns1.example.",
+		"ns1.example. 3600 IN A 192.0.2.2",
+		"other. 3600 IN NS ns.other.",
+		"ns.other. 3600 IN A 192.0.2.4",
+		"victim. 3600 IN NS ns.victim.",
+		"ns.victim. 3600 IN A 192.0.2.5")
+	n.example = newTestZone(t, "example.",
+		"www.example. 300 IN A 192.0.2.80",
+		"alias.example. 300 IN CNAME www.sub.example.",
+		// The nameserver of sub.example. is outside the zone, so its
+		// address here is not glue the zone can vouch for.
+		"sub.example. 3600 IN NS ns.other.",
+		"ns.other. 3600 IN A 192.0.2.66",
+		"spoof.example. 300 IN CNAME www.victim.",
+		"www.victim. 300 IN A 203.0.113.66")
+	n.sub = newTestZone(t, "sub.example.",
+		"www.sub.example. 300 IN A 192.0.2.81")
+	n.other = newTestZone(t, "other.",
+		"ns.other. 3600 IN A 192.0.2.3")
+	n.victim = newTestZone(t, "victim.",
+		"www.victim. 300 IN A 192.0.2.82")
+	n.attacker = newTestZone(t, ".",
+		"*. 300 IN A 203.0.113.66")
+
+	for ip, zone := range map[string]*testZone{
+		"192.0.2.1":  n.root,
+		"192.0.2.2":  n.example,
+		"192.0.2.3":  n.sub,
+		"192.0.2.4":  n.other,
+		"192.0.2.5":  n.victim,
+		"192.0.2.66": n.attacker,
+	} {
+		address, shutdown := startDNSServer(t, zone.serveDNS)
+		n.addresses[ip] = address
+		n.shutdown = append(n.shutdown, shutdown)
+	}
+	return n
+}
+
+func (n *testNetwork) stop() {
+	for _, shutdown := range n.shutdown {
+		shutdown()
+	}
+}
+
+// createRecursiveResolver builds a recursive resolver whose root hints point
+// at the root of the test network.
+func createRecursiveResolver(t *testing.T, n *testNetwork, options string) *recursiveResolver {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hints := filepath.Join(dir, "named.root")
+	if err := ioutil.WriteFile(hints, []byte(". 3600000 NS a.root.test.\na.root.test. 3600000 A 192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := newUpstream("recursive://?timeout=1s&hints=" + hints + options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.name() != "recursive" {
+		t.Fatalf("Unexpected upstream name %q", u.name())
+	}
+	r := u.resolver.(*recursiveResolver)
+	r.address = func(ip net.IP) string {
+		if address, ok := n.addresses[ip.String()]; ok {
+			return address
+		}
+		return "127.0.0.1:1"
+	}
+	return r
+}
+
+func resolveRecursively(t *testing.T, r *recursiveResolver, name string) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	response, err := r.resolve(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Id != query.Id || !response.RecursionAvailable {
+		t.Fatalf("Unexpected response header %v", response)
+	}
+	return response
+}
+
+func answerAddresses(response *dns.Msg) []string {
+	addresses := make([]string, 0)
+	for _, rr := range response.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			addresses = append(addresses, a.A.String())
+		}
+	}
+	return addresses
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+
+	response := resolveRecursively(t, r, "WWW.example.")
+	if addresses := answerAddresses(response); len(addresses) != 1 || addresses[0] != "192.0.2.80" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	for _, name := range n.root.received() {
+		if name != "example." {
+			t.Fatalf("Root server was asked for %s", name)
+		}
+	}
+}
+
+func TestRecursiveResolverWithoutMinimisation(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "&qmin=false")
+
+	resolveRecursively(t, r, "www.example.")
+	if received := n.root.received(); len(received) != 1 || received[0] != "www.example." {
+		t.Fatalf("Root server was asked for %v", received)
+	}
+}
+
+func TestRecursiveResolverFollowsCNAME(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+
+	response := resolveRecursively(t, r, "alias.example.")
+	if len(response.Answer) != 2 {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	if cname, ok := response.Answer[0].(*dns.CNAME); !ok || cname.Target != "www.sub.example." {
+		t.Fatalf("Answer does not start with the CNAME record: %v", response.Answer)
+	}
+	if addresses := answerAddresses(response); len(addresses) != 1 || addresses[0] != "192.0.2.81" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	if received := n.attacker.received(); len(received) != 0 {
+		t.Fatalf("Out of bailiwick glue was used to send %v", received)
+	}
+}
+
+func TestRecursiveResolverIgnoresOutOfBailiwickAnswers(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+
+	response := resolveRecursively(t, r, "spoof.example.")
+	if addresses := answerAddresses(response); len(addresses) != 1 || addresses[0] != "192.0.2.82" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	if received := n.victim.received(); len(received) == 0 {
+		t.Fatal("CNAME target was not resolved from its own zone")
+	}
+}
+
+func TestRecursiveResolverNXDOMAIN(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+
+	response := resolveRecursively(t, r, "a.b.missing.example.")
+	if response.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN, got %s", dns.RcodeToString[response.Rcode])
+	}
+	if len(response.Ns) != 1 || response.Ns[0].Header().Name != "example." {
+		t.Fatalf("Expected the SOA record of example., got %v", response.Ns)
+	}
+	for _, name := range n.example.received() {
+		if name != "missing.example." {
+			t.Fatalf("Server of example. was asked for %s below a missing name", name)
+		}
+	}
+}
+
+func TestRecursiveResolverCachesDelegations(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+
+	resolveRecursively(t, r, "www.example.")
+	rootQueries := len(n.root.received())
+	response := resolveRecursively(t, r, "www.sub.example.")
+	if addresses := answerAddresses(response); len(addresses) != 1 || addresses[0] != "192.0.2.81" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	exampleQueries := len(n.example.received())
+	resolveRecursively(t, r, "www.sub.example.")
+	if len(n.example.received()) != exampleQueries {
+		t.Fatal("Cached delegation of sub.example. was not used")
+	}
+	// Only the glueless nameserver of sub.example. sent the resolver back
+	// to the root.
+	for _, name := range n.root.received()[rootQueries:] {
+		if name != "other." {
+			t.Fatalf("Root server was asked for %s again", name)
+		}
+	}
+}
+
+func TestRecursiveResolverServerFailure(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+	r.roots.servers = []net.IP{net.ParseIP("192.0.2.99")}
+
+	response := resolveRecursively(t, r, "www.example.")
+	if response.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL, got %s", dns.RcodeToString[response.Rcode])
+	}
+}
+
+func TestRecursiveResolverFallsBackToTCP(t *testing.T) {
+	n := startTestNetwork(t)
+	defer n.stop()
+	r := createRecursiveResolver(t, n, "")
+
+	stall := make(chan struct{})
+	tcpQueries := make(chan string, 10)
+	address, shutdown := startDNSServer(t, func(w dns.ResponseWriter, query *dns.Msg) {
+		if w.RemoteAddr().Network() == "udp" {
+			truncated := new(dns.Msg)
+			truncated.SetReply(query)
+			truncated.Truncated = true
+			w.WriteMsg(truncated)
+			return
+		}
+		tcpQueries <- query.Question[0].Name
+		if query.Question[0].Name == "stall.example." {
+			<-stall
+		}
+		n.example.serveDNS(w, query)
+	})
+	defer shutdown()
+	defer close(stall)
+	n.addresses["192.0.2.2"] = address
+
+	response := resolveRecursively(t, r, "www.example.")
+	if addresses := answerAddresses(response); len(addresses) != 1 || addresses[0] != "192.0.2.80" {
+		t.Fatalf("Unexpected answer %v", response.Answer)
+	}
+	if len(tcpQueries) == 0 {
+		t.Fatal("Truncated answer was not retried over TCP")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	query := new(dns.Msg)
+	query.SetQuestion("stall.example.", dns.TypeA)
+	start := time.Now()
+	if _, err := r.resolve(ctx, query); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("TCP exchange outlived the deadline by %v", elapsed-100*time.Millisecond)
+	}
+}
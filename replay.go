@@ -0,0 +1,195 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+const (
+	// Queries expected per replay window when ODOH_REPLAY_CAPACITY is unset
+	defaultReplayCapacity = 1000000
+
+	// False positive rate of each filter generation at its expected capacity.
+	// A false positive rejects a fresh query as a replay.
+	replayFalsePositiveRate = 1e-6
+)
+
+// bloomFilter is a fixed-size Bloom filter over SHA-256 digests. Bit positions
+// are derived from two halves of the digest by double hashing.
+type bloomFilter struct {
+	bits   []uint64
+	hashes int
+}
+
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	size := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(size / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (int(size)+63)/64),
+		hashes: hashes,
+	}
+}
+
+func (f *bloomFilter) position(digest [sha256.Size]byte, i int) (int, uint64) {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16])
+	bit := (h1 + uint64(i)*h2) % uint64(len(f.bits)*64)
+	return int(bit / 64), 1 << (bit % 64)
+}
+
+func (f *bloomFilter) contains(digest [sha256.Size]byte) bool {
+	for i := 0; i < f.hashes; i++ {
+		word, mask := f.position(digest, i)
+		if f.bits[word]&mask == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) insert(digest [sha256.Size]byte) {
+	for i := 0; i < f.hashes; i++ {
+		word, mask := f.position(digest, i)
+		f.bits[word] |= mask
+	}
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
+
+// replayGuard remembers recently answered ODoH queries so that a captured
+// query replayed through a proxy is rejected rather than resolved again.
+//
+// Every query carries a fresh HPKE encapsulated key, and it only decrypts if
+// the ciphertext that follows is unchanged, so a replay is a byte-for-byte
+// copy of a query already seen. The guard fingerprints the whole message,
+// which covers the encapsulated key without knowing the KEM of keys held by an
+// external provider.
+//
+// Fingerprints go to two Bloom filters that swap every window, so a query is
+// remembered for at least one window and at most two, in bounded memory.
+type replayGuard struct {
+	sync.Mutex
+	window             time.Duration
+	salt               []byte
+	current            *bloomFilter
+	previous           *bloomFilter
+	rotated            time.Time
+	rejected           int
+	totalRejected      int
+	telemetryClient    *telemetry
+	serverInstanceName string
+	experimentId       string
+}
+
+// newReplayGuard creates a guard sized for capacity queries per window.
+func newReplayGuard(window time.Duration, capacity int, now time.Time) *replayGuard {
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return &replayGuard{
+		window:   window,
+		salt:     salt,
+		current:  newBloomFilter(capacity, replayFalsePositiveRate),
+		previous: newBloomFilter(capacity, replayFalsePositiveRate),
+		rotated:  now,
+	}
+}
+
+func (g *replayGuard) fingerprint(message odoh.ObliviousDNSMessage) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write(g.salt)
+	hash.Write(message.Marshal())
+	var digest [sha256.Size]byte
+	copy(digest[:], hash.Sum(nil))
+	return digest
+}
+
+// rotateLocked moves to the window containing now, forgetting queries seen
+// more than a window before it started.
+func (g *replayGuard) rotateLocked(now time.Time) {
+	elapsed := now.Sub(g.rotated)
+	if elapsed < g.window {
+		return
+	}
+
+	g.report(now)
+	if elapsed >= 2*g.window {
+		g.current.reset()
+	}
+	g.previous.reset()
+	g.current, g.previous = g.previous, g.current
+	g.rotated = g.rotated.Add(elapsed - elapsed%g.window)
+	g.rejected = 0
+}
+
+func (g *replayGuard) report(now time.Time) {
+	if g.rejected == 0 || g.telemetryClient == nil {
+		return
+	}
+	e := replayEvent{
+		Event:         "replays_rejected",
+		WindowStart:   g.rotated.UnixNano(),
+		Rejected:      g.rejected,
+		TotalRejected: g.totalRejected,
+		Timestamp:     now.UnixNano(),
+		IngestedFrom:  g.serverInstanceName,
+		ExperimentID:  g.experimentId,
+	}
+	g.telemetryClient.stream([]string{e.serialize()})
+}
+
+// seen records message and reports whether it was already recorded in the
+// current or previous window.
+func (g *replayGuard) seen(message odoh.ObliviousDNSMessage, now time.Time) bool {
+	digest := g.fingerprint(message)
+
+	g.Lock()
+	defer g.Unlock()
+	g.rotateLocked(now)
+	if g.current.contains(digest) || g.previous.contains(digest) {
+		g.rejected++
+		g.totalRejected++
+		return true
+	}
+	g.current.insert(digest)
+	return false
+}
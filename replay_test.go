@@ -0,0 +1,121 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+func createObliviousMessage(t *testing.T, target targetServer, query []byte) odoh.ObliviousDNSMessage {
+	obliviousQuery := odoh.CreateObliviousDNSQuery(query, 0)
+	message, _, err := target.odohKeys.configs().Configs[0].Contents.EncryptQuery(obliviousQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(100, replayFalsePositiveRate)
+	guard := newReplayGuard(time.Minute, 100, time.Now())
+
+	inserted := guard.fingerprint(odoh.ObliviousDNSMessage{EncryptedMessage: []byte("inserted")})
+	other := guard.fingerprint(odoh.ObliviousDNSMessage{EncryptedMessage: []byte("other")})
+	filter.insert(inserted)
+	if !filter.contains(inserted) {
+		t.Fatal("Filter lost an inserted digest")
+	}
+	if filter.contains(other) {
+		t.Fatal("Filter contains a digest that was never inserted")
+	}
+
+	filter.reset()
+	if filter.contains(inserted) {
+		t.Fatal("Filter kept a digest after reset")
+	}
+}
+
+func TestReplayGuardWindows(t *testing.T) {
+	now := time.Now()
+	guard := newReplayGuard(time.Minute, 100, now)
+	message := odoh.ObliviousDNSMessage{MessageType: odoh.QueryType, EncryptedMessage: []byte("query")}
+
+	if guard.seen(message, now) {
+		t.Fatal("Fresh query reported as a replay")
+	}
+	if !guard.seen(message, now.Add(30*time.Second)) {
+		t.Fatal("Replay within the window not detected")
+	}
+	if !guard.seen(message, now.Add(90*time.Second)) {
+		t.Fatal("Replay in the following window not detected")
+	}
+	if guard.seen(message, now.Add(3*time.Minute)) {
+		t.Fatal("Query remembered for more than two windows")
+	}
+	if guard.totalRejected != 2 {
+		t.Fatalf("Expected 2 rejected replays, got %d", guard.totalRejected)
+	}
+}
+
+func TestQueryHandlerODoHReplay(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	target.replayGuard = newReplayGuard(time.Minute, 100, time.Now())
+
+	message := createObliviousMessage(t, target, []byte(r.queries[0]))
+	if status := postObliviousQuery(t, target, message).Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+	if status := postObliviousQuery(t, target, message).Result().StatusCode; status != http.StatusTooEarly {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusTooEarly, status))
+	}
+
+	fresh := createObliviousMessage(t, target, []byte(r.queries[0]))
+	if status := postObliviousQuery(t, target, fresh).Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+}
+
+func TestQueryHandlerODoHReplayIgnoresInvalidQueries(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	target.replayGuard = newReplayGuard(time.Minute, 100, time.Now())
+
+	message := createObliviousMessage(t, target, []byte(r.queries[0]))
+	corrupt := message
+	corrupt.EncryptedMessage = append([]byte{}, message.EncryptedMessage...)
+	corrupt.EncryptedMessage[len(corrupt.EncryptedMessage)-1] ^= 0xFF
+	for i := 0; i < 2; i++ {
+		if status := postObliviousQuery(t, target, corrupt).Result().StatusCode; status != http.StatusBadRequest {
+			t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+		}
+	}
+	if guard := target.replayGuard; guard.totalRejected != 0 {
+		t.Fatalf("Invalid queries counted as replays: %d", guard.totalRejected)
+	}
+}
@@ -23,46 +23,222 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	// EDNS buffer size advertised over UDP, as recommended by DNS Flag Day
+	// 2020 to avoid IP fragmentation
+	defaultUDPBufferSize = 1232
+)
+
+var errTruncated = errors.New("truncated response")
+
+// resolver answers queries. Resolution stops early with the context's error
+// when it is cancelled or its deadline passes.
 type resolver interface {
 	name() string
-	resolve(query *dns.Msg) (*dns.Msg, error)
+	resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
 }
 
+// targetResolver forwards queries to a nameserver over pooled TCP
+// connections.
 type targetResolver struct {
 	nameserver string
 	timeout    time.Duration
+	pool       *tcpPool
+}
+
+func newTargetResolver(nameserver string, timeout time.Duration, connections int) targetResolver {
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", nameserver, timeout)
+	}
+	return targetResolver{
+		nameserver: nameserver,
+		timeout:    timeout,
+		pool:       newTCPPool(dial, timeout, connections),
+	}
+}
+
+// parseConnections reads the connections option, the size of the connection
+// pool of an upstream.
+func parseConnections(config upstreamConfig) (int, error) {
+	setting := config.options.Get("connections")
+	if setting == "" {
+		return defaultTCPConnections, nil
+	}
+	connections, err := strconv.Atoi(setting)
+	if err != nil || connections <= 0 {
+		return 0, fmt.Errorf("upstream %s: invalid connections %q", config.name, setting)
+	}
+	return connections, nil
+}
+
+func newTCPResolver(config upstreamConfig) (resolver, error) {
+	if err := config.checkOptions("connections"); err != nil {
+		return nil, err
+	}
+	connections, err := parseConnections(config)
+	if err != nil {
+		return nil, err
+	}
+	return newTargetResolver(config.address(defaultDNSPort), config.timeout, connections), nil
 }
 
 func (s targetResolver) name() string {
 	return s.nameserver
 }
 
-func (s targetResolver) resolve(query *dns.Msg) (*dns.Msg, error) {
-	connection := new(dns.Conn)
-	var err error
-	if connection.Conn, err = net.DialTimeout("tcp", s.nameserver, s.timeout*time.Millisecond); err != nil {
-		return nil, fmt.Errorf("Failed starting resolver connection")
+func (s targetResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	return s.pool.exchange(ctx, query)
+}
+
+// udpResolver forwards queries to a nameserver over UDP, and retries over TCP
+// when the response is truncated. Every query is sent from a fresh socket, so
+// that the OS picks a random source port, with a random message ID.
+type udpResolver struct {
+	nameserver string
+	timeout    time.Duration
+	bufferSize uint16
+	tcp        targetResolver
+}
+
+func newUDPResolver(config upstreamConfig) (resolver, error) {
+	if err := config.checkOptions("bufsize", "connections"); err != nil {
+		return nil, err
 	}
+	connections, err := parseConnections(config)
+	if err != nil {
+		return nil, err
+	}
+	bufferSize := uint16(defaultUDPBufferSize)
+	if setting := config.options.Get("bufsize"); setting != "" {
+		size, err := strconv.ParseUint(setting, 10, 16)
+		if err != nil || size < dns.MinMsgSize {
+			return nil, fmt.Errorf("upstream %s: invalid bufsize %q", config.name, setting)
+		}
+		bufferSize = uint16(size)
+	}
+	nameserver := config.address(defaultDNSPort)
+	return udpResolver{
+		nameserver: nameserver,
+		timeout:    config.timeout,
+		bufferSize: bufferSize,
+		tcp:        newTargetResolver(nameserver, config.timeout, connections),
+	}, nil
+}
+
+func (s udpResolver) name() string {
+	return s.nameserver
+}
+
+// matchesQuestion reports whether response answers the question of query.
+func matchesQuestion(query *dns.Msg, response *dns.Msg) bool {
+	if !response.Response || response.Id != query.Id || len(response.Question) != len(query.Question) {
+		return false
+	}
+	for i, question := range query.Question {
+		answered := response.Question[i]
+		if !strings.EqualFold(answered.Name, question.Name) || answered.Qtype != question.Qtype || answered.Qclass != question.Qclass {
+			return false
+		}
+	}
+	return true
+}
+
+func (s udpResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	response, err := s.exchange(ctx, query)
+	if err == errTruncated {
+		return s.tcp.resolve(ctx, query)
+	}
+	return response, err
+}
 
-	connection.SetReadDeadline(time.Now().Add(s.timeout * time.Millisecond))
-	connection.SetWriteDeadline(time.Now().Add(s.timeout * time.Millisecond))
+func (s udpResolver) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	return exchangeUDP(ctx, s.nameserver, query, s.bufferSize, s.timeout)
+}
 
-	if err := connection.WriteMsg(query); err != nil {
+// exchangeUDP sends query to nameserver from a fresh socket with a random
+// message ID, advertising bufferSize, and waits at most timeout for the
+// response. It fails with errTruncated if the response is truncated.
+func exchangeUDP(ctx context.Context, nameserver string, query *dns.Msg, bufferSize uint16, timeout time.Duration) (*dns.Msg, error) {
+	upstreamQuery := query.Copy()
+	upstreamQuery.Id = dns.Id()
+	clientEDNS := query.IsEdns0() != nil
+	if opt := upstreamQuery.IsEdns0(); opt != nil {
+		opt.SetUDPSize(bufferSize)
+	} else {
+		upstreamQuery.SetEdns0(bufferSize, false)
+	}
+	packedQuery, err := upstreamQuery.Pack()
+	if err != nil {
 		return nil, err
 	}
 
-	response, err := connection.ReadMsg()
+	dialer := net.Dialer{Timeout: timeout}
+	connection, err := dialer.DialContext(ctx, "udp", nameserver)
 	if err != nil {
+		return nil, fmt.Errorf("Failed starting resolver connection")
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(timeout))
+
+	// Cancelling the context interrupts the pending read.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if _, err := connection.Write(packedQuery); err != nil {
 		return nil, err
 	}
 
-	response.Id = query.Id
-	return response, nil
+	// Datagrams that do not answer the query, e.g. spoofed or late responses,
+	// are dropped until one does or the deadline passes.
+	buffer := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := connection.Read(buffer)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			return nil, err
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(buffer[:n]); err != nil || !matchesQuestion(upstreamQuery, response) {
+			continue
+		}
+		if response.Truncated {
+			return nil, errTruncated
+		}
+
+		response.Id = query.Id
+		if !clientEDNS {
+			removeOPT(response)
+		}
+		return response, nil
+	}
+}
+
+// removeOPT drops the OPT record of a response to a query that had none.
+func removeOPT(response *dns.Msg) {
+	extra := response.Extra[:0]
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	response.Extra = extra
 }
@@ -0,0 +1,169 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDNSServer serves handler over UDP and TCP on the same local port.
+func startDNSServer(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	for attempt := 0; attempt < 10; attempt++ {
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+		if err != nil {
+			packetConn.Close()
+			continue
+		}
+
+		udpServer := &dns.Server{PacketConn: packetConn, Handler: handler}
+		tcpServer := &dns.Server{Listener: listener, Handler: handler}
+		go udpServer.ActivateAndServe()
+		go tcpServer.ActivateAndServe()
+		return packetConn.LocalAddr().String(), func() {
+			udpServer.Shutdown()
+			tcpServer.Shutdown()
+		}
+	}
+	t.Fatal("Failed to listen on the same UDP and TCP port")
+	return "", nil
+}
+
+func answerA(query *dns.Msg, address string) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(address),
+	}}
+	return response
+}
+
+func createUDPResolver(t *testing.T, address string) resolver {
+	u, err := newUpstream("udp://" + address + "?timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUDPResolver(t *testing.T) {
+	upstreamQueries := make(chan *dns.Msg, 1)
+	address, shutdown := startDNSServer(t, func(w dns.ResponseWriter, query *dns.Msg) {
+		upstreamQueries <- query
+		w.WriteMsg(answerA(query, "192.0.2.1"))
+	})
+	defer shutdown()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response, err := createUDPResolver(t, address).resolve(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Id != query.Id || len(response.Answer) != 1 {
+		t.Fatalf("Unexpected response %v", response)
+	}
+	if response.IsEdns0() != nil {
+		t.Fatal("Response carries an OPT record the client did not ask for")
+	}
+	if opt := (<-upstreamQueries).IsEdns0(); opt == nil || opt.UDPSize() != defaultUDPBufferSize {
+		t.Fatal("Upstream query does not advertise the EDNS buffer size")
+	}
+}
+
+func TestUDPResolverIgnoresMismatchedResponses(t *testing.T) {
+	address, shutdown := startDNSServer(t, func(w dns.ResponseWriter, query *dns.Msg) {
+		spoofed := answerA(query, "203.0.113.1")
+		spoofed.Id++
+		w.WriteMsg(spoofed)
+
+		other := query.Copy()
+		other.Question[0].Name = "example.net."
+		w.WriteMsg(answerA(other, "203.0.113.2"))
+
+		w.WriteMsg(answerA(query, "192.0.2.1"))
+	})
+	defer shutdown()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response, err := createUDPResolver(t, address).resolve(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := response.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Accepted a mismatched response with address %v", a.A)
+	}
+}
+
+func TestUDPResolverFallsBackToTCP(t *testing.T) {
+	address, shutdown := startDNSServer(t, func(w dns.ResponseWriter, query *dns.Msg) {
+		if w.RemoteAddr().Network() == "udp" {
+			truncated := new(dns.Msg)
+			truncated.SetReply(query)
+			truncated.Truncated = true
+			w.WriteMsg(truncated)
+			return
+		}
+		w.WriteMsg(answerA(query, "192.0.2.1"))
+	})
+	defer shutdown()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response, err := createUDPResolver(t, address).resolve(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Truncated || len(response.Answer) != 1 {
+		t.Fatalf("Expected the full answer over TCP, got %v", response)
+	}
+}
+
+func TestUDPResolverTimeout(t *testing.T) {
+	address, shutdown := startDNSServer(t, func(w dns.ResponseWriter, query *dns.Msg) {})
+	defer shutdown()
+
+	u, err := newUpstream("udp://" + address + "?timeout=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, err := u.resolve(context.Background(), query); err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Timeout took %v", elapsed)
+	}
+}
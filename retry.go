@@ -0,0 +1,142 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultMaxAttempts   = 3
+	defaultQueryDeadline = 5 * time.Second
+)
+
+var errQueryDeadline = errors.New("query deadline exceeded")
+
+// retryable reports whether a response should be retried on another upstream.
+func retryable(response *dns.Msg) bool {
+	return response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused
+}
+
+type attemptResult struct {
+	slot     int
+	index    int
+	response *dns.Msg
+	err      error
+	duration time.Duration
+}
+
+// exchange resolves query, moving on to another upstream after a transport
+// error, a timeout, SERVFAIL or REFUSED, and hedging on another upstream if
+// the first one is slow. It returns the first other answer or, failing that,
+// the last SERVFAIL or REFUSED answer, along with every attempt made.
+// Attempts still in flight when it returns are cancelled.
+func (s *upstreamSelector) exchange(query *dns.Msg) (*dns.Msg, upstream, []upstreamAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryDeadline)
+	defer cancel()
+
+	tried := make(map[int]bool)
+	attempts := make([]upstreamAttempt, 0, 1)
+	results := make(chan attemptResult, s.maxAttempts)
+	inFlight := 0
+	start := func(hedged bool) bool {
+		if len(attempts) >= s.maxAttempts || ctx.Err() != nil {
+			return false
+		}
+		index := s.choose(query, time.Now(), tried)
+		if index < 0 {
+			return false
+		}
+		tried[index] = true
+		attempts = append(attempts, upstreamAttempt{Upstream: s.upstreams[index].name(), Hedged: hedged})
+		inFlight++
+		go func(slot int, upstreamQuery *dns.Msg) {
+			started := time.Now()
+			response, err := s.upstreams[index].resolve(ctx, upstreamQuery)
+			duration := time.Since(started)
+			s.report(index, duration, err, time.Now())
+			results <- attemptResult{slot, index, response, err, duration}
+		}(len(attempts)-1, query.Copy())
+		return true
+	}
+
+	start(false)
+	var hedge <-chan time.Time
+	if delay, ok := s.hedgeDelay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	var response *dns.Msg
+	var answered upstream
+	var err error
+	for inFlight > 0 {
+		select {
+		case <-hedge:
+			hedge = nil
+			start(true)
+			continue
+		case result := <-results:
+			inFlight--
+			record := &attempts[result.slot]
+			record.Duration = result.duration.Nanoseconds()
+			if errors.Is(result.err, context.DeadlineExceeded) {
+				result.err = errQueryDeadline
+			}
+			if result.err != nil {
+				record.Error = result.err.Error()
+				if response == nil {
+					err = result.err
+				}
+			} else {
+				record.Rcode = dns.RcodeToString[result.response.Rcode]
+				response, answered = result.response, s.upstreams[result.index]
+				if !retryable(response) {
+					markCancelled(attempts)
+					return response, answered, attempts, nil
+				}
+			}
+		}
+		if inFlight == 0 {
+			start(false)
+		}
+	}
+	if response == nil {
+		return nil, upstream{}, attempts, err
+	}
+	return response, answered, attempts, nil
+}
+
+// markCancelled records the attempts left in flight once a query is answered.
+func markCancelled(attempts []upstreamAttempt) {
+	for i := range attempts {
+		if attempts[i].Rcode == "" && attempts[i].Error == "" {
+			attempts[i].Error = context.Canceled.Error()
+		}
+	}
+}
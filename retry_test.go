@@ -0,0 +1,240 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// scriptedResolver answers every query with the same response code or error,
+// after an optional delay.
+type scriptedResolver struct {
+	rcode     int
+	err       error
+	delay     time.Duration
+	calls     int32
+	cancelled int32
+}
+
+func (r *scriptedResolver) name() string {
+	return "scripted"
+}
+
+func (r *scriptedResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&r.calls, 1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		atomic.AddInt32(&r.cancelled, 1)
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	response := &dns.Msg{}
+	response.SetRcode(query, r.rcode)
+	return response, nil
+}
+
+func createScriptedSelector(resolvers ...resolver) *upstreamSelector {
+	upstreams := make([]upstream, len(resolvers))
+	for i, r := range resolvers {
+		upstreams[i] = upstream{resolver: r, label: string(rune('a' + i)), weight: 1}
+	}
+	return newUpstreamSelector(upstreams, strategyRoundRobin)
+}
+
+func TestRetryAfterTransportError(t *testing.T) {
+	failing := &scriptedResolver{err: errors.New("connection refused")}
+	working := &scriptedResolver{rcode: dns.RcodeSuccess}
+	selector := createScriptedSelector(failing, working)
+
+	response, answered, attempts, err := selector.exchange(questionFor("example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeSuccess || answered.name() != "b" {
+		t.Fatalf("Unexpected answer %v from %s", dns.RcodeToString[response.Rcode], answered.name())
+	}
+	if len(attempts) != 2 || attempts[0].Upstream != "a" || attempts[0].Error == "" || attempts[1].Rcode != "NOERROR" {
+		t.Fatalf("Unexpected attempts %+v", attempts)
+	}
+}
+
+func TestRetryAfterServerFailure(t *testing.T) {
+	refusing := &scriptedResolver{rcode: dns.RcodeRefused}
+	failing := &scriptedResolver{rcode: dns.RcodeServerFailure}
+	unreachable := &scriptedResolver{err: errors.New("network is unreachable")}
+	selector := createScriptedSelector(refusing, failing, unreachable)
+
+	response, answered, attempts, err := selector.exchange(questionFor("example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeServerFailure || answered.name() != "b" {
+		t.Fatalf("Unexpected answer %v from %s", dns.RcodeToString[response.Rcode], answered.name())
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("Unexpected attempts %+v", attempts)
+	}
+
+	// Upstreams are tried at most once per query, and no more than allowed.
+	selector.maxAttempts = 2
+	if _, _, attempts, _ := selector.exchange(questionFor("example.com.")); len(attempts) != 2 {
+		t.Fatalf("Unexpected attempts %+v", attempts)
+	}
+	if calls := atomic.LoadInt32(&refusing.calls) + atomic.LoadInt32(&failing.calls) + atomic.LoadInt32(&unreachable.calls); calls != 5 {
+		t.Fatalf("Upstreams were queried %d times", calls)
+	}
+}
+
+func TestRetryWithinDeadline(t *testing.T) {
+	slow := &scriptedResolver{rcode: dns.RcodeSuccess, delay: time.Second}
+	selector := createScriptedSelector(slow, slow)
+	selector.queryDeadline = 50 * time.Millisecond
+
+	start := time.Now()
+	_, _, attempts, err := selector.exchange(questionFor("example.com."))
+	if !errors.Is(err, errQueryDeadline) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Exchange took %v", elapsed)
+	}
+	if len(attempts) != 1 || attempts[0].Error != errQueryDeadline.Error() {
+		t.Fatalf("Unexpected attempts %+v", attempts)
+	}
+}
+
+func TestTargetRetriesFailedUpstream(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	target.upstreams = createScriptedSelector(&scriptedResolver{err: errors.New("connection refused")}, r)
+
+	request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader([]byte(r.queries[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", dnsMessageContentType)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.targetQueryHandler).ServeHTTP(rr, request)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Query yielded %d", rr.Code)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), r.queryResponseMap[r.queries[0]]) {
+		t.Fatal("Incorrect response")
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	selector := createScriptedSelector(&scriptedResolver{}, &scriptedResolver{})
+	selector.hedgePercentile = 95
+	now := time.Now()
+	for i := 1; i < minHedgeLatencySamples; i++ {
+		selector.report(0, time.Duration(i)*time.Millisecond, nil, now)
+	}
+	if _, ok := selector.hedgeDelay(); ok {
+		t.Fatal("Hedging before enough latencies are known")
+	}
+	for i := minHedgeLatencySamples; i <= 100; i++ {
+		selector.report(1, time.Duration(i)*time.Millisecond, nil, now)
+	}
+	if delay, ok := selector.hedgeDelay(); !ok || delay != 95*time.Millisecond {
+		t.Fatalf("Unexpected hedge delay %v", delay)
+	}
+
+	selector.hedgeMinDelay = time.Second
+	if delay, _ := selector.hedgeDelay(); delay != time.Second {
+		t.Fatalf("Hedge delay %v below the minimum", delay)
+	}
+	selector.maxAttempts = 1
+	if _, ok := selector.hedgeDelay(); ok {
+		t.Fatal("Hedging without retries")
+	}
+}
+
+func TestHedgedQuery(t *testing.T) {
+	slow := &scriptedResolver{rcode: dns.RcodeSuccess, delay: time.Second}
+	fast := &scriptedResolver{rcode: dns.RcodeSuccess}
+	selector := createScriptedSelector(slow, fast)
+	selector.hedgePercentile = 90
+	selector.hedgeMinDelay = time.Millisecond
+	for i := 0; i < minHedgeLatencySamples; i++ {
+		selector.recordLatencyLocked(20 * time.Millisecond)
+	}
+
+	start := time.Now()
+	response, answered, attempts, err := selector.exchange(questionFor("example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Hedged query took %v", elapsed)
+	}
+	if response.Rcode != dns.RcodeSuccess || answered.name() != "b" {
+		t.Fatalf("Unexpected answer %v from %s", dns.RcodeToString[response.Rcode], answered.name())
+	}
+	if len(attempts) != 2 || attempts[0].Hedged || !attempts[1].Hedged || attempts[0].Error != context.Canceled.Error() {
+		t.Fatalf("Unexpected attempts %+v", attempts)
+	}
+
+	// The slower query is cancelled without counting against its upstream.
+	for i := 0; atomic.LoadInt32(&slow.cancelled) == 0; i++ {
+		if i == 100 {
+			t.Fatal("Slower query was not cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	selector.Lock()
+	defer selector.Unlock()
+	if selector.health[0].consecutiveFailures != 0 || selector.health[0].errorRate != 0 {
+		t.Fatalf("Cancelled query counted as a failure: %+v", selector.health[0])
+	}
+}
+
+func TestHedgingWaitsForFastAnswers(t *testing.T) {
+	first := &scriptedResolver{rcode: dns.RcodeSuccess}
+	second := &scriptedResolver{rcode: dns.RcodeSuccess}
+	selector := createScriptedSelector(first, second)
+	selector.hedgePercentile = 90
+	selector.hedgeMinDelay = 200 * time.Millisecond
+	for i := 0; i < minHedgeLatencySamples; i++ {
+		selector.recordLatencyLocked(time.Millisecond)
+	}
+
+	if _, _, attempts, err := selector.exchange(questionFor("example.com.")); err != nil || len(attempts) != 1 {
+		t.Fatalf("Unexpected attempts %+v: %v", attempts, err)
+	}
+	if calls := atomic.LoadInt32(&second.calls); calls != 0 {
+		t.Fatal("Query hedged although the first upstream answered in time")
+	}
+}
@@ -0,0 +1,227 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+const (
+	// Lower bound on how often the rotator wakes up to check for work.
+	minimumRotationCheckInterval = time.Second
+)
+
+// keyRotator periodically replaces the active ODoH key with a freshly
+// generated one. The previous key keeps being accepted for gracePeriod so that
+// clients holding a cached config are not broken mid-flight.
+//
+// When epochs is set, keys are derived from the fleet master secret instead of
+// generated, and rotation happens at epoch boundaries rather than every
+// interval.
+type keyRotator struct {
+	keys               *targetKeySet
+	interval           time.Duration
+	gracePeriod        time.Duration
+	suites             []cipherSuite
+	generate           func(suite cipherSuite) (odoh.ObliviousDoHKeyPair, error)
+	epochs             *epochKeyDeriver
+	telemetryClient    *telemetry
+	serverInstanceName string
+	experimentId       string
+	lastRotation       time.Time
+	epoch              int64
+}
+
+func (r *keyRotator) cipherSuites() []cipherSuite {
+	if len(r.suites) == 0 {
+		return []cipherSuite{defaultCipherSuite}
+	}
+	return r.suites
+}
+
+func (r *keyRotator) report(event string, keyIDs [][]byte, state keyState, now time.Time) {
+	items := make([]string, 0, len(keyIDs))
+	for _, keyID := range keyIDs {
+		e := keyEvent{
+			Event:        event,
+			KeyID:        hex.EncodeToString(keyID),
+			State:        state.String(),
+			Timestamp:    now.UnixNano(),
+			IngestedFrom: r.serverInstanceName,
+			ExperimentID: r.experimentId,
+		}
+		items = append(items, e.serialize())
+	}
+	if len(items) > 0 && r.telemetryClient != nil {
+		r.telemetryClient.stream(items)
+	}
+}
+
+// rotate generates a new key for each cipher suite, publishes them and starts
+// retiring the keys they replace.
+func (r *keyRotator) rotate(now time.Time) error {
+	keyPairs := make([]odoh.ObliviousDoHKeyPair, 0)
+	keyIDs := make([][]byte, 0)
+	for _, suite := range r.cipherSuites() {
+		keyPair, err := r.generate(suite)
+		if err != nil {
+			return err
+		}
+		keyPairs = append(keyPairs, keyPair)
+		keyIDs = append(keyIDs, keyPair.Config.Contents.KeyID())
+		log.Printf("Rotated ODoH key: now advertising %x (%v)", keyIDs[len(keyIDs)-1], suite)
+	}
+
+	retiring := r.keys.rotate(keyPairs, now, now.Add(r.gracePeriod))
+	r.lastRotation = now
+
+	for _, retiringKeyID := range retiring {
+		log.Printf("Retiring ODoH key %x at %v", retiringKeyID, now.Add(r.gracePeriod))
+	}
+	r.report("generated", keyIDs, keyStateActive, now)
+	r.report("retiring", retiring, keyStateRetiring, now)
+	return nil
+}
+
+// rotateToEpoch installs the keys of the epoch containing now: the epoch key
+// is advertised, the next epoch's key is accepted ahead of time to absorb
+// clock skew across the fleet, and the previous epoch's key is accepted until
+// the grace period after the epoch boundary ends.
+func (r *keyRotator) rotateToEpoch(now time.Time) error {
+	derive := func(epoch int64) ([]odoh.ObliviousDoHKeyPair, error) {
+		keyPairs := make([]odoh.ObliviousDoHKeyPair, 0)
+		for _, suite := range r.cipherSuites() {
+			keyPair, err := r.epochs.keyPair(epoch, suite)
+			if err != nil {
+				return nil, err
+			}
+			keyPairs = append(keyPairs, keyPair)
+		}
+		return keyPairs, nil
+	}
+
+	epoch := r.epochs.epoch(now)
+	previous, err := derive(epoch - 1)
+	if err != nil {
+		return err
+	}
+	current, err := derive(epoch)
+	if err != nil {
+		return err
+	}
+	next, err := derive(epoch + 1)
+	if err != nil {
+		return err
+	}
+
+	retireAt := r.epochs.epochStart(epoch).Add(r.gracePeriod)
+	retiring := r.keys.rotate(current, now, retireAt)
+	if now.Before(retireAt) {
+		for _, keyPair := range previous {
+			if r.keys.set(keyPair, keyStateRetiring, now, retireAt) {
+				retiring = append(retiring, keyPair.Config.Contents.KeyID())
+			}
+		}
+	}
+	pending := make([][]byte, 0)
+	for _, keyPair := range next {
+		if r.keys.set(keyPair, keyStatePending, now, time.Time{}) {
+			pending = append(pending, keyPair.Config.Contents.KeyID())
+		}
+	}
+	r.epoch = epoch
+	r.lastRotation = now
+
+	keyIDs := make([][]byte, 0, len(current))
+	for _, keyPair := range current {
+		keyIDs = append(keyIDs, keyPair.Config.Contents.KeyID())
+		log.Printf("Entered key epoch %d: now advertising %x", epoch, keyIDs[len(keyIDs)-1])
+	}
+	r.report("derived", keyIDs, keyStateActive, now)
+	r.report("retiring", retiring, keyStateRetiring, now)
+	r.report("derived", pending, keyStatePending, now)
+	return nil
+}
+
+// tick rotates the active key if it is due and drops keys whose grace period
+// has ended.
+func (r *keyRotator) tick(now time.Time) {
+	if r.epochs != nil {
+		if r.epochs.epoch(now) != r.epoch {
+			if err := r.rotateToEpoch(now); err != nil {
+				log.Println("Key rotation failed:", err)
+			}
+		}
+	} else if now.Sub(r.lastRotation) >= r.interval {
+		if err := r.rotate(now); err != nil {
+			log.Println("Key rotation failed:", err)
+		}
+	}
+
+	r.expire(now)
+}
+
+// expire drops keys whose grace period has ended. Besides tick, it runs on
+// its own when keys are not rotated, since keys may still be retired through
+// the admin API or be restored from the keystore in the retiring state.
+func (r *keyRotator) expire(now time.Time) {
+	expired := r.keys.expire(now)
+	for _, keyID := range expired {
+		log.Printf("Retired ODoH key %x", keyID)
+	}
+	r.report("retired", expired, keyStateRetired, now)
+}
+
+func (r *keyRotator) checkInterval() time.Duration {
+	check := r.interval
+	if r.gracePeriod > 0 && r.gracePeriod < check {
+		check = r.gracePeriod
+	}
+	check = check / 4
+	if check < minimumRotationCheckInterval {
+		check = minimumRotationCheckInterval
+	}
+	return check
+}
+
+// run drives rotation until stop is closed. Unless a rotation already
+// happened, the keys present when run is called count as freshly rotated.
+func (r *keyRotator) run(stop <-chan struct{}) {
+	if r.lastRotation.IsZero() {
+		r.lastRotation = time.Now()
+	}
+	ticker := time.NewTicker(r.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.tick(now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+func sendObliviousQuery(t *testing.T, target *targetServer, config odoh.ObliviousDoHConfig, query []byte) int {
+	obliviousQuery := odoh.CreateObliviousDNSQuery(query, 0)
+	encryptedQuery, _, err := config.Contents.EncryptQuery(obliviousQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(encryptedQuery.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", odohMessageContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.targetQueryHandler).ServeHTTP(rr, request)
+	return rr.Result().StatusCode
+}
+
+func TestKeyRotation(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	oldConfig := target.odohKeys.configs().Configs[0]
+
+	start := time.Now()
+	rotator := &keyRotator{
+		keys:         target.odohKeys,
+		interval:     time.Hour,
+		gracePeriod:  10 * time.Minute,
+		generate:     cipherSuite.generateKeyPair,
+		lastRotation: start,
+	}
+
+	rotator.tick(start.Add(30 * time.Minute))
+	if configs := target.odohKeys.configs().Configs; len(configs) != 1 || !bytes.Equal(configs[0].Marshal(), oldConfig.Marshal()) {
+		t.Fatal("Key rotated before the rotation interval elapsed")
+	}
+
+	rotationTime := start.Add(time.Hour)
+	rotator.tick(rotationTime)
+	configs := target.odohKeys.configs().Configs
+	if len(configs) != 1 {
+		t.Fatalf("Expected a single advertised config, got %d", len(configs))
+	}
+	newConfig := configs[0]
+	if bytes.Equal(newConfig.Marshal(), oldConfig.Marshal()) {
+		t.Fatal("Rotation did not advertise a new config")
+	}
+
+	q := []byte(r.queries[0])
+	if status := sendObliviousQuery(t, &target, newConfig, q); status != http.StatusOK {
+		t.Fatalf("Query to new key failed with %d", status)
+	}
+	if status := sendObliviousQuery(t, &target, oldConfig, q); status != http.StatusOK {
+		t.Fatalf("Query to retiring key failed with %d", status)
+	}
+
+	rotator.tick(rotationTime.Add(10 * time.Minute))
+	if status := sendObliviousQuery(t, &target, oldConfig, q); status != http.StatusUnauthorized {
+		t.Fatalf("Query to retired key yielded %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := sendObliviousQuery(t, &target, newConfig, q); status != http.StatusOK {
+		t.Fatalf("Query to new key failed with %d", status)
+	}
+}
+
+func TestKeyExpiryWithoutRotation(t *testing.T) {
+	store, cleanup := createKeyStore(t)
+	defer cleanup()
+
+	keys := newTargetKeySet()
+	keys.store = store
+	oldKeyPair := createKeyPair(t)
+	keys.add(oldKeyPair)
+	keys.add(createKeyPair(t))
+	oldKeyID := oldKeyPair.Config.Contents.KeyID()
+	if err := keys.retire(oldKeyID, time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	rotator := &keyRotator{keys: keys}
+	stop := make(chan struct{})
+	defer close(stop)
+	go reportEvery(10*time.Millisecond, stop, rotator.expire)
+
+	for i := 0; len(keys.describe()) != 1; i++ {
+		if i == 100 {
+			t.Fatal("Retired key was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	loaded, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || bytes.Equal(loaded[0].keyID, oldKeyID) {
+		t.Fatal("Keystore still holds the secret of the retired key")
+	}
+}
+
+func createEpochRotator(masterSecret []byte) *keyRotator {
+	return &keyRotator{
+		keys:        newTargetKeySet(),
+		interval:    time.Hour,
+		gracePeriod: 10 * time.Minute,
+		epochs: &epochKeyDeriver{
+			masterSecret: masterSecret,
+			epochLength:  time.Hour,
+		},
+	}
+}
+
+func TestEpochKeyDerivationIsDeterministic(t *testing.T) {
+	masterSecret := []byte("fleet master secret for testing!")
+	now := time.Unix(1600000000, 0)
+
+	first := createEpochRotator(masterSecret)
+	second := createEpochRotator(masterSecret)
+	if err := first.rotateToEpoch(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.rotateToEpoch(now.Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.keys.configs().Marshal(), second.keys.configs().Marshal()) {
+		t.Fatal("Instances sharing a master secret advertise different configs")
+	}
+
+	other := createEpochRotator([]byte("a different fleet master secret"))
+	if err := other.rotateToEpoch(now); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.keys.configs().Marshal(), other.keys.configs().Marshal()) {
+		t.Fatal("Different master secrets derived the same config")
+	}
+}
+
+func TestEpochKeyRotation(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	rotator := createEpochRotator([]byte("fleet master secret for testing!"))
+	target.odohKeys = rotator.keys
+	q := []byte(r.queries[0])
+
+	epochStart := rotator.epochs.epochStart(rotator.epochs.epoch(time.Now()))
+	rotator.tick(epochStart.Add(20 * time.Minute))
+
+	previousKey, err := rotator.epochs.keyPair(rotator.epoch-1, defaultCipherSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentKey, err := rotator.epochs.keyPair(rotator.epoch, defaultCipherSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextKey, err := rotator.epochs.keyPair(rotator.epoch+1, defaultCipherSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configs := target.odohKeys.configs().Configs
+	if len(configs) != 1 || !bytes.Equal(configs[0].Marshal(), currentKey.Config.Marshal()) {
+		t.Fatal("Target does not advertise the current epoch key")
+	}
+	if status := sendObliviousQuery(t, &target, previousKey.Config, q); status != http.StatusUnauthorized {
+		t.Fatalf("Query to previous epoch key past its grace period yielded %d", status)
+	}
+	if status := sendObliviousQuery(t, &target, nextKey.Config, q); status != http.StatusOK {
+		t.Fatalf("Query to next epoch key failed with %d", status)
+	}
+
+	rotator.tick(epochStart.Add(time.Hour + time.Minute))
+	configs = target.odohKeys.configs().Configs
+	if len(configs) != 1 || !bytes.Equal(configs[0].Marshal(), nextKey.Config.Marshal()) {
+		t.Fatal("Target did not advance to the next epoch key")
+	}
+	if status := sendObliviousQuery(t, &target, currentKey.Config, q); status != http.StatusOK {
+		t.Fatalf("Query to previous epoch key within its grace period failed with %d", status)
+	}
+
+	rotator.tick(epochStart.Add(time.Hour + 10*time.Minute))
+	if status := sendObliviousQuery(t, &target, currentKey.Config, q); status != http.StatusUnauthorized {
+		t.Fatalf("Query to retired epoch key yielded %d", status)
+	}
+}
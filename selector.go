@@ -0,0 +1,295 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type selectionStrategy int
+
+const (
+	// Weighted random picks upstreams at random in proportion to their
+	// weight.
+	strategyWeightedRandom selectionStrategy = iota
+	// Round robin cycles through upstreams, each getting a share of queries
+	// in proportion to its weight.
+	strategyRoundRobin
+	// Lowest latency picks the upstream expected to answer successfully
+	// soonest, occasionally trying another one to keep measurements fresh.
+	strategyLowestLatency
+	// Qname hashing sends every name to the same upstream, so that upstream
+	// caches are not split, unless that upstream is ejected.
+	strategyQnameHash
+)
+
+const (
+	// Smoothing factor of the latency and error rate averages
+	healthSmoothing = 0.2
+
+	// Share of queries the lowest latency strategy sends to a random upstream
+	latencyExplorationRate = 0.05
+
+	defaultFailureThreshold = 5
+	defaultEjectionDuration = 30 * time.Second
+)
+
+func (s selectionStrategy) String() string {
+	switch s {
+	case strategyWeightedRandom:
+		return "random"
+	case strategyRoundRobin:
+		return "round-robin"
+	case strategyLowestLatency:
+		return "lowest-latency"
+	case strategyQnameHash:
+		return "qname-hash"
+	default:
+		return "unknown"
+	}
+}
+
+func parseSelectionStrategy(name string) (selectionStrategy, error) {
+	for _, s := range []selectionStrategy{strategyWeightedRandom, strategyRoundRobin, strategyLowestLatency, strategyQnameHash} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return strategyWeightedRandom, fmt.Errorf("unknown upstream strategy %q", name)
+}
+
+// upstreamHealth tracks how an upstream has been answering. An upstream
+// failing failureThreshold times in a row is ejected; once the ejection
+// duration has passed, a single query is let through as a probe, and its
+// outcome either restores the upstream or ejects it again.
+type upstreamHealth struct {
+	latency             time.Duration
+	errorRate           float64
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	probing             bool
+	roundRobinCredit    int
+}
+
+// upstreamSelector chooses the upstream of each query according to a
+// strategy, among the upstreams that are not ejected. If every upstream is
+// ejected, all of them are candidates again. Failed queries are retried on
+// other upstreams, up to maxAttempts upstreams within queryDeadline. With a
+// hedge percentile, a query still unanswered after the hedge delay is also
+// sent to another upstream.
+type upstreamSelector struct {
+	sync.Mutex
+	upstreams        []upstream
+	health           []upstreamHealth
+	strategy         selectionStrategy
+	failureThreshold int
+	ejectionDuration time.Duration
+	maxAttempts      int
+	queryDeadline    time.Duration
+	hedgePercentile  float64
+	hedgeMinDelay    time.Duration
+	latencies        []time.Duration
+	nextLatency      int
+}
+
+func newUpstreamSelector(upstreams []upstream, strategy selectionStrategy) *upstreamSelector {
+	return &upstreamSelector{
+		upstreams:        upstreams,
+		health:           make([]upstreamHealth, len(upstreams)),
+		strategy:         strategy,
+		failureThreshold: defaultFailureThreshold,
+		ejectionDuration: defaultEjectionDuration,
+		maxAttempts:      defaultMaxAttempts,
+		queryDeadline:    defaultQueryDeadline,
+		hedgeMinDelay:    defaultHedgeMinDelay,
+	}
+}
+
+// candidatesLocked returns the indices of the upstreams that may take a query,
+// leaving out those already tried. An ejected upstream whose ejection has
+// ended is a candidate if no probe is in flight for it.
+func (s *upstreamSelector) candidatesLocked(now time.Time, tried map[int]bool) []int {
+	candidates := make([]int, 0, len(s.upstreams))
+	for i := range s.upstreams {
+		health := &s.health[i]
+		if !tried[i] && (health.ejectedUntil.IsZero() || (!now.Before(health.ejectedUntil) && !health.probing)) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range s.upstreams {
+			if !tried[i] {
+				candidates = append(candidates, i)
+			}
+		}
+	}
+	return candidates
+}
+
+func (s *upstreamSelector) weightedRandomLocked(candidates []int) int {
+	total := 0
+	for _, i := range candidates {
+		total += s.upstreams[i].weight
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	choice := rand.Intn(total)
+	for _, i := range candidates {
+		if choice < s.upstreams[i].weight {
+			return i
+		}
+		choice -= s.upstreams[i].weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// roundRobinLocked implements smooth weighted round robin: every candidate
+// earns its weight in credit, and the richest one is chosen and pays back the
+// total.
+func (s *upstreamSelector) roundRobinLocked(candidates []int) int {
+	total := 0
+	chosen := candidates[0]
+	for _, i := range candidates {
+		s.health[i].roundRobinCredit += s.upstreams[i].weight
+		total += s.upstreams[i].weight
+		if s.health[i].roundRobinCredit > s.health[chosen].roundRobinCredit {
+			chosen = i
+		}
+	}
+	s.health[chosen].roundRobinCredit -= total
+	return chosen
+}
+
+// lowestLatencyLocked prefers upstreams that were never measured, then the
+// one with the lowest latency scaled up by its error rate.
+func (s *upstreamSelector) lowestLatencyLocked(candidates []int) int {
+	if rand.Float64() < latencyExplorationRate {
+		return s.weightedRandomLocked(candidates)
+	}
+	chosen := -1
+	bestScore := math.Inf(1)
+	for _, i := range candidates {
+		health := s.health[i]
+		if health.latency == 0 {
+			return i
+		}
+		score := float64(health.latency) / math.Max(1-health.errorRate, 0.01)
+		if score < bestScore {
+			chosen, bestScore = i, score
+		}
+	}
+	return chosen
+}
+
+// qnameHashLocked uses weighted rendezvous hashing, so that ejecting an
+// upstream only moves the names it was serving.
+func (s *upstreamSelector) qnameHashLocked(candidates []int, query *dns.Msg) int {
+	qname := ""
+	if len(query.Question) > 0 {
+		qname = strings.ToLower(query.Question[0].Name)
+	}
+	chosen := candidates[0]
+	bestScore := math.Inf(-1)
+	for _, i := range candidates {
+		hash := fnv.New64a()
+		hash.Write([]byte(qname))
+		hash.Write([]byte{0})
+		hash.Write([]byte(s.upstreams[i].name()))
+		// Map the hash to (0, 1) and weigh it.
+		uniform := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(s.upstreams[i].weight) / math.Log(uniform)
+		if score > bestScore {
+			chosen, bestScore = i, score
+		}
+	}
+	return chosen
+}
+
+// choose returns the index of the upstream that should answer query, other
+// than those tried already, or -1 if every upstream was tried.
+func (s *upstreamSelector) choose(query *dns.Msg, now time.Time, tried map[int]bool) int {
+	s.Lock()
+	defer s.Unlock()
+
+	candidates := s.candidatesLocked(now, tried)
+	if len(candidates) == 0 {
+		return -1
+	}
+	var chosen int
+	switch s.strategy {
+	case strategyRoundRobin:
+		chosen = s.roundRobinLocked(candidates)
+	case strategyLowestLatency:
+		chosen = s.lowestLatencyLocked(candidates)
+	case strategyQnameHash:
+		chosen = s.qnameHashLocked(candidates, query)
+	default:
+		chosen = s.weightedRandomLocked(candidates)
+	}
+	if !s.health[chosen].ejectedUntil.IsZero() {
+		s.health[chosen].probing = true
+	}
+	return chosen
+}
+
+// report records the outcome of a query sent to upstream index. Queries
+// cancelled because another upstream answered first are not counted.
+func (s *upstreamSelector) report(index int, latency time.Duration, err error, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	health := &s.health[index]
+	health.probing = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		health.errorRate += healthSmoothing * (1 - health.errorRate)
+		health.consecutiveFailures++
+		if health.consecutiveFailures >= s.failureThreshold || !health.ejectedUntil.IsZero() {
+			health.ejectedUntil = now.Add(s.ejectionDuration)
+		}
+		return
+	}
+
+	health.errorRate -= healthSmoothing * health.errorRate
+	health.consecutiveFailures = 0
+	health.ejectedUntil = time.Time{}
+	s.recordLatencyLocked(latency)
+	if health.latency == 0 {
+		health.latency = latency
+	} else {
+		health.latency += time.Duration(healthSmoothing * float64(latency-health.latency))
+	}
+}
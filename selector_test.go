@@ -0,0 +1,229 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func createSelector(t *testing.T, strategy selectionStrategy, weights ...int) *upstreamSelector {
+	r := createLocalResolver(t)
+	upstreams := make([]upstream, len(weights))
+	for i, weight := range weights {
+		upstreams[i] = upstream{resolver: r, label: string(rune('a' + i)), weight: weight}
+	}
+	return newUpstreamSelector(upstreams, strategy)
+}
+
+func questionFor(name string) *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion(name, dns.TypeA)
+	return query
+}
+
+func TestParseSelectionStrategy(t *testing.T) {
+	for _, name := range []string{"random", "round-robin", "lowest-latency", "qname-hash"} {
+		strategy, err := parseSelectionStrategy(name)
+		if err != nil || strategy.String() != name {
+			t.Fatalf("Parsing %q yielded %v, %v", name, strategy, err)
+		}
+	}
+	if _, err := parseSelectionStrategy("fastest"); err == nil {
+		t.Fatal("Unknown strategy accepted")
+	}
+}
+
+func TestWeightedRandomSkipsZeroWeight(t *testing.T) {
+	selector := createSelector(t, strategyWeightedRandom, 0, 5)
+	for i := 0; i < 100; i++ {
+		if chosen := selector.choose(questionFor("example.com."), time.Now(), nil); chosen != 1 {
+			t.Fatalf("Chose upstream %d", chosen)
+		}
+	}
+}
+
+func TestRoundRobinFollowsWeights(t *testing.T) {
+	selector := createSelector(t, strategyRoundRobin, 2, 1)
+	counts := make([]int, 2)
+	previous := -1
+	for i := 0; i < 9; i++ {
+		chosen := selector.choose(questionFor("example.com."), time.Now(), nil)
+		if chosen == 1 && previous == 1 {
+			t.Fatal("Round robin chose the lighter upstream twice in a row")
+		}
+		counts[chosen]++
+		previous = chosen
+	}
+	if counts[0] != 6 || counts[1] != 3 {
+		t.Fatalf("Unexpected distribution %v", counts)
+	}
+}
+
+func TestLowestLatencyPrefersFastUpstream(t *testing.T) {
+	selector := createSelector(t, strategyLowestLatency, 1, 1)
+	now := time.Now()
+	selector.report(0, 15*time.Millisecond, nil, now)
+	selector.report(1, 10*time.Millisecond, nil, now)
+
+	counts := make([]int, 2)
+	for i := 0; i < 1000; i++ {
+		counts[selector.choose(questionFor("example.com."), now, nil)]++
+	}
+	if counts[1] < 900 || counts[0] == 0 {
+		t.Fatalf("Unexpected distribution %v", counts)
+	}
+
+	// Errors make a fast upstream less attractive than a reliable one.
+	for i := 0; i < 4; i++ {
+		selector.report(1, 0, errUpstreamTimeout, now)
+	}
+	selector.report(1, 10*time.Millisecond, nil, now)
+	counts = make([]int, 2)
+	for i := 0; i < 1000; i++ {
+		counts[selector.choose(questionFor("example.com."), now, nil)]++
+	}
+	if counts[0] < 900 {
+		t.Fatalf("Unexpected distribution after errors %v", counts)
+	}
+}
+
+func TestQnameHashIsStable(t *testing.T) {
+	selector := createSelector(t, strategyQnameHash, 1, 1, 1)
+	now := time.Now()
+	names := []string{"a.example.", "b.example.", "c.example.", "d.example.", "e.example.", "f.example.", "g.example.", "h.example."}
+	chosen := make(map[string]int)
+	used := make(map[int]bool)
+	for _, name := range names {
+		chosen[name] = selector.choose(questionFor(name), now, nil)
+		used[chosen[name]] = true
+		if again := selector.choose(questionFor(strings.ToUpper(name)), now, nil); again != chosen[name] {
+			t.Fatalf("%s moved from upstream %d to %d", name, chosen[name], again)
+		}
+	}
+	if len(used) < 2 {
+		t.Fatal("Every name hashed to the same upstream")
+	}
+
+	// Ejecting an upstream only moves the names it served.
+	selector.failureThreshold = 1
+	selector.report(0, 0, errUpstreamTimeout, now)
+	for _, name := range names {
+		again := selector.choose(questionFor(name), now, nil)
+		if again == 0 || (chosen[name] != 0 && again != chosen[name]) {
+			t.Fatalf("%s moved from upstream %d to %d", name, chosen[name], again)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	selector := createSelector(t, strategyRoundRobin, 1, 1)
+	selector.failureThreshold = 3
+	selector.ejectionDuration = time.Minute
+	now := time.Now()
+	failure := errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		selector.report(0, 0, failure, now)
+	}
+	selector.report(0, time.Millisecond, nil, now)
+	for i := 0; i < 2; i++ {
+		selector.report(0, 0, failure, now)
+	}
+	if !selector.health[0].ejectedUntil.IsZero() {
+		t.Fatal("Upstream ejected without consecutive failures reaching the threshold")
+	}
+	selector.report(0, 0, failure, now)
+	for i := 0; i < 10; i++ {
+		if chosen := selector.choose(questionFor("example.com."), now, nil); chosen != 1 {
+			t.Fatal("Ejected upstream was chosen")
+		}
+	}
+
+	// After the ejection, a single probe is let through at a time.
+	later := now.Add(time.Minute)
+	probes := 0
+	for i := 0; i < 10; i++ {
+		if selector.choose(questionFor("example.com."), later, nil) == 0 {
+			probes++
+		}
+	}
+	if probes != 1 {
+		t.Fatalf("Sent %d probes, expected 1", probes)
+	}
+
+	// A failed probe ejects the upstream again; a successful one restores it.
+	selector.report(0, 0, failure, later)
+	if selector.choose(questionFor("example.com."), later, nil) == 0 {
+		t.Fatal("Upstream chosen after a failed probe")
+	}
+	evenLater := later.Add(time.Minute)
+	for selector.choose(questionFor("example.com."), evenLater, nil) != 0 {
+	}
+	selector.report(0, time.Millisecond, nil, evenLater)
+	probes = 0
+	for i := 0; i < 10; i++ {
+		if selector.choose(questionFor("example.com."), evenLater, nil) == 0 {
+			probes++
+		}
+	}
+	if probes != 5 {
+		t.Fatalf("Restored upstream took %d of 10 queries", probes)
+	}
+}
+
+func TestAllUpstreamsEjected(t *testing.T) {
+	selector := createSelector(t, strategyWeightedRandom, 1)
+	selector.failureThreshold = 1
+	now := time.Now()
+	selector.report(0, 0, errUpstreamTimeout, now)
+	if chosen := selector.choose(questionFor("example.com."), now, nil); chosen != 0 {
+		t.Fatalf("Chose upstream %d", chosen)
+	}
+}
+
+func TestSelectorExchangeRecordsOutcome(t *testing.T) {
+	r := createLocalResolver(t)
+	selector := newUpstreamSelector([]upstream{{resolver: r, label: "local", weight: 1}}, strategyWeightedRandom)
+	query := &dns.Msg{}
+	if err := query.Unpack([]byte(r.queries[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, chosen, _, err := selector.exchange(query); err != nil || chosen.name() != "local" {
+		t.Fatalf("Exchange through %s failed: %v", chosen.name(), err)
+	}
+	if selector.health[0].latency == 0 || selector.health[0].errorRate != 0 {
+		t.Fatalf("Unexpected health %+v", selector.health[0])
+	}
+
+	if _, _, _, err := selector.exchange(questionFor("unknown.example.")); err == nil {
+		t.Fatal("Exchange of an unknown query succeeded")
+	}
+	if selector.health[0].consecutiveFailures != 1 || selector.health[0].errorRate == 0 {
+		t.Fatalf("Failure not recorded: %+v", selector.health[0])
+	}
+}
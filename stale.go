@@ -0,0 +1,149 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// TTL of stale answers, and time after which a stale answer is served if
+	// no fresh one arrived, as recommended by RFC 8767
+	staleAnswerTTL       = 30
+	defaultStaleDeadline = 1800 * time.Millisecond
+
+	// Extended DNS Errors (RFC 8914) are sent as a local option: this version
+	// of miekg/dns does not know them.
+	ednsExtendedErrorCode    = 15
+	extendedErrorStaleAnswer = 3
+)
+
+// addExtendedError adds an Extended DNS Error to a response to an EDNS query.
+func addExtendedError(response *dns.Msg, infoCode uint16) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, infoCode)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsExtendedErrorCode, Data: data})
+}
+
+// stale returns the expired answer to query if it expired less than the stale
+// window ago, with a short TTL and an Extended DNS Error marking it stale
+// (RFC 8767). It returns nil otherwise.
+func (c *answerCache) stale(query *dns.Msg, now time.Time) *dns.Msg {
+	key, ok := newCacheKey(query)
+	if !ok || c.staleWindow == 0 {
+		return nil
+	}
+	entry, ok := c.lookup(key)
+	if !ok || now.Before(entry.expires) || !now.Before(entry.expires.Add(c.staleWindow)) {
+		return nil
+	}
+
+	response := entry.answer(query, now)
+	records(response, func(rr dns.RR) {
+		rr.Header().Ttl = staleAnswerTTL
+	})
+	addExtendedError(response, extendedErrorStaleAnswer)
+	atomic.AddUint64(&c.staleHits, 1)
+	return response
+}
+
+// upstreamResolution is the outcome of resolving a query upstream. Coalesced
+// resolutions were shared with an identical query.
+type upstreamResolution struct {
+	response  *dns.Msg
+	answered  upstream
+	attempts  []upstreamAttempt
+	err       error
+	coalesced bool
+}
+
+// exchange resolves q upstream, sharing the exchange of an identical query in
+// flight, and caches the answer.
+func (s *targetServer) exchange(q *dns.Msg) upstreamResolution {
+	if s.coalescer != nil {
+		return s.coalescer.do(q, s.exchangeAndCache)
+	}
+	return s.exchangeAndCache(q)
+}
+
+func (s *targetServer) exchangeAndCache(q *dns.Msg) upstreamResolution {
+	var r upstreamResolution
+	r.response, r.answered, r.attempts, r.err = s.upstreams.exchange(q)
+	if r.err == nil && s.cache != nil {
+		s.cache.set(q, r.response, time.Now())
+	}
+	return r
+}
+
+// resolveUpstream resolves q upstream, and records the attempts in exp. If the
+// cache holds a stale answer, it is returned instead when resolution fails,
+// yields SERVFAIL or REFUSED, or takes longer than the stale deadline; in the
+// latter case resolution goes on in the background to refresh the cache.
+func (s *targetServer) resolveUpstream(q *dns.Msg, exp *experiment) (*dns.Msg, error) {
+	var stale *dns.Msg
+	if s.cache != nil {
+		stale = s.cache.stale(q, time.Now())
+	}
+	if stale == nil {
+		r := s.exchange(q)
+		exp.Attempts = r.attempts
+		exp.Coalesced = r.coalesced
+		if r.err != nil {
+			return nil, r.err
+		}
+		exp.Resolver = r.answered.name()
+		return r.response, nil
+	}
+
+	results := make(chan upstreamResolution, 1)
+	go func() {
+		results <- s.exchange(q)
+	}()
+	var deadline <-chan time.Time
+	if s.cache.staleDeadline > 0 {
+		timer := time.NewTimer(s.cache.staleDeadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case r := <-results:
+		exp.Attempts = r.attempts
+		exp.Coalesced = r.coalesced
+		if r.err == nil && !retryable(r.response) {
+			exp.Resolver = r.answered.name()
+			return r.response, nil
+		}
+	case <-deadline:
+	}
+	exp.StaleAnswer = true
+	return stale, nil
+}
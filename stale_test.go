@@ -0,0 +1,168 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func extendedError(response *dns.Msg) (uint16, bool) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == ednsExtendedErrorCode && len(local.Data) >= 2 {
+			return binary.BigEndian.Uint16(local.Data), true
+		}
+	}
+	return 0, false
+}
+
+func TestCacheServesStaleWithinWindow(t *testing.T) {
+	cache := newAnswerCache(100, 0, time.Hour)
+	now := time.Now()
+	query := questionFor("example.com.")
+	query.SetEdns0(1232, false)
+	cache.set(query, answerA(query, "192.0.2.1"), now)
+
+	if cache.stale(query, now.Add(time.Hour)) != nil {
+		t.Fatal("Stale answer served without a stale window")
+	}
+	cache.staleWindow = time.Hour
+	if cache.stale(query, now.Add(30*time.Second)) != nil {
+		t.Fatal("Fresh answer served as stale")
+	}
+
+	response := cache.stale(query, now.Add(30*time.Minute))
+	if response == nil {
+		t.Fatal("Stale answer not served")
+	}
+	if ttl := response.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Fatalf("Stale answer has TTL %d", ttl)
+	}
+	if code, ok := extendedError(response); !ok || code != extendedErrorStaleAnswer {
+		t.Fatal("Stale answer lacks the Stale Answer extended error")
+	}
+
+	// The extended error survives a round trip.
+	packed, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked := &dns.Msg{}
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if code, ok := extendedError(unpacked); !ok || code != extendedErrorStaleAnswer {
+		t.Fatal("Extended error lost when packing the answer")
+	}
+
+	if cache.stale(query, now.Add(time.Minute+time.Hour)) != nil {
+		t.Fatal("Answer served beyond the stale window")
+	}
+	if cache.staleHits != 1 {
+		t.Fatalf("Counted %d stale hits", cache.staleHits)
+	}
+}
+
+// createStaleTarget returns a target whose cache holds an expired answer for
+// example.com.
+func createStaleTarget(t *testing.T, r resolver) (targetServer, *dns.Msg) {
+	target := createTarget(t, r)
+	target.cache = newAnswerCache(100, 0, time.Hour)
+	target.cache.staleWindow = time.Hour
+	query := questionFor("example.com.")
+	target.cache.set(query, answerA(query, "192.0.2.1"), time.Now().Add(-10*time.Minute))
+	return target, query
+}
+
+func resolveForTest(t *testing.T, target *targetServer, query *dns.Msg) (*dns.Msg, experiment) {
+	exp := experiment{}
+	packed, err := target.resolveQuery(query, &exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &dns.Msg{}
+	if err := response.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	return response, exp
+}
+
+func TestTargetServesStaleOnFailure(t *testing.T) {
+	for _, r := range []*scriptedResolver{
+		{err: errors.New("connection refused")},
+		{rcode: dns.RcodeServerFailure},
+	} {
+		target, query := createStaleTarget(t, r)
+		response, exp := resolveForTest(t, &target, query)
+		if !exp.StaleAnswer || len(response.Answer) != 1 || response.Answer[0].Header().Ttl != staleAnswerTTL {
+			t.Fatalf("Unexpected answer %v", response)
+		}
+		if len(exp.Attempts) == 0 {
+			t.Fatal("Failed attempts not recorded")
+		}
+	}
+}
+
+func TestTargetServesStaleAfterDeadline(t *testing.T) {
+	r := &countingResolver{delay: 200 * time.Millisecond}
+	target, query := createStaleTarget(t, r)
+	target.cache.staleDeadline = 20 * time.Millisecond
+
+	start := time.Now()
+	response, exp := resolveForTest(t, &target, query)
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("Stale answer served after %v", elapsed)
+	}
+	if !exp.StaleAnswer || response.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("Unexpected answer %v", response)
+	}
+
+	// Resolution goes on and refreshes the cache.
+	for i := 0; target.cache.get(query, time.Now()) == nil; i++ {
+		if i == 50 {
+			t.Fatal("Cache not refreshed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	response, exp = resolveForTest(t, &target, query)
+	if exp.StaleAnswer || !exp.CacheHit || response.Answer[0].Header().Ttl == staleAnswerTTL {
+		t.Fatalf("Unexpected answer after refresh %v", response)
+	}
+}
+
+func TestTargetPrefersFreshAnswers(t *testing.T) {
+	r := &countingResolver{}
+	target, query := createStaleTarget(t, r)
+	response, exp := resolveForTest(t, &target, query)
+	if exp.StaleAnswer || exp.Resolver != "counting" || response.Answer[0].Header().Ttl != 60 {
+		t.Fatalf("Unexpected answer %v", response)
+	}
+}
@@ -0,0 +1,129 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cisco/go-hpke"
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+// cipherSuite is the HPKE suite of an ODoH key. Suites are named
+// KEM-KDF-AEAD, e.g. X25519-SHA256-AES128GCM or P256-SHA256-CHACHA20POLY1305.
+type cipherSuite struct {
+	kemID  hpke.KEMID
+	kdfID  hpke.KDFID
+	aeadID hpke.AEADID
+}
+
+var (
+	defaultCipherSuite = cipherSuite{
+		kemID:  hpke.DHKEM_X25519,
+		kdfID:  hpke.KDF_HKDF_SHA256,
+		aeadID: hpke.AEAD_AESGCM128,
+	}
+
+	// The SIKE KEMs are absent: their encapsulation is not the size of a
+	// public key, which the ODoH message format relies on.
+	kemNames = map[hpke.KEMID]string{
+		hpke.DHKEM_P256:   "P256",
+		hpke.DHKEM_P521:   "P521",
+		hpke.DHKEM_X25519: "X25519",
+		hpke.DHKEM_X448:   "X448",
+	}
+	kdfNames = map[hpke.KDFID]string{
+		hpke.KDF_HKDF_SHA256: "SHA256",
+		hpke.KDF_HKDF_SHA384: "SHA384",
+		hpke.KDF_HKDF_SHA512: "SHA512",
+	}
+	aeadNames = map[hpke.AEADID]string{
+		hpke.AEAD_AESGCM128:        "AES128GCM",
+		hpke.AEAD_AESGCM256:        "AES256GCM",
+		hpke.AEAD_CHACHA20POLY1305: "CHACHA20POLY1305",
+	}
+)
+
+func cipherSuiteOf(contents odoh.ObliviousDoHConfigContents) cipherSuite {
+	return cipherSuite{
+		kemID:  contents.KemID,
+		kdfID:  contents.KdfID,
+		aeadID: contents.AeadID,
+	}
+}
+
+func (c cipherSuite) String() string {
+	return fmt.Sprintf("%s-%s-%s", kemNames[c.kemID], kdfNames[c.kdfID], aeadNames[c.aeadID])
+}
+
+func (c cipherSuite) hpkeSuite() (hpke.CipherSuite, error) {
+	return hpke.AssembleCipherSuite(c.kemID, c.kdfID, c.aeadID)
+}
+
+func (c cipherSuite) generateKeyPair() (odoh.ObliviousDoHKeyPair, error) {
+	return odoh.CreateKeyPair(c.kemID, c.kdfID, c.aeadID)
+}
+
+func (c cipherSuite) keyPairFromSeed(seed []byte) (odoh.ObliviousDoHKeyPair, error) {
+	return odoh.CreateKeyPairFromSeed(c.kemID, c.kdfID, c.aeadID, seed)
+}
+
+// supportedCipherSuites lists every suite ODoH keys can be created for.
+func supportedCipherSuites() []cipherSuite {
+	kemIDs := []hpke.KEMID{hpke.DHKEM_X25519, hpke.DHKEM_X448, hpke.DHKEM_P256, hpke.DHKEM_P521}
+	kdfIDs := []hpke.KDFID{hpke.KDF_HKDF_SHA256, hpke.KDF_HKDF_SHA384, hpke.KDF_HKDF_SHA512}
+	aeadIDs := []hpke.AEADID{hpke.AEAD_AESGCM128, hpke.AEAD_AESGCM256, hpke.AEAD_CHACHA20POLY1305}
+
+	suites := make([]cipherSuite, 0, len(kemIDs)*len(kdfIDs)*len(aeadIDs))
+	for _, kemID := range kemIDs {
+		for _, kdfID := range kdfIDs {
+			for _, aeadID := range aeadIDs {
+				suites = append(suites, cipherSuite{kemID, kdfID, aeadID})
+			}
+		}
+	}
+	return suites
+}
+
+func parseCipherSuite(name string) (cipherSuite, error) {
+	for _, suite := range supportedCipherSuites() {
+		if strings.EqualFold(suite.String(), name) {
+			return suite, nil
+		}
+	}
+	return cipherSuite{}, fmt.Errorf("unsupported cipher suite %q", name)
+}
+
+// parseCipherSuites parses a comma-separated list of suite names.
+func parseCipherSuites(setting string) ([]cipherSuite, error) {
+	suites := make([]cipherSuite, 0)
+	for _, name := range strings.Split(setting, ",") {
+		suite, err := parseCipherSuite(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
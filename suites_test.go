@@ -0,0 +1,131 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	odoh "github.com/cloudflare/odoh-go"
+)
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("X25519-SHA256-AES128GCM, p256-sha256-chacha20poly1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suites) != 2 || suites[0] != defaultCipherSuite || suites[1].String() != "P256-SHA256-CHACHA20POLY1305" {
+		t.Fatalf("Unexpected suites %v", suites)
+	}
+
+	for _, name := range []string{"", "X25519-SHA256", "SIKE503-SHA256-AES128GCM", "X25519-SHA256-EXPORTONLY"} {
+		if _, err := parseCipherSuite(name); err == nil {
+			t.Fatalf("Accepted unsupported suite %q", name)
+		}
+	}
+}
+
+func TestQueryHandlerODoHWithEveryCipherSuite(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	target.odohKeys = newTargetKeySet()
+
+	for _, suite := range supportedCipherSuites() {
+		keyPair, err := suite.generateKeyPair()
+		if err != nil {
+			t.Fatalf("%v: %v", suite, err)
+		}
+		target.odohKeys.add(keyPair)
+	}
+
+	handler := http.HandlerFunc(target.targetQueryHandler)
+	configs := target.odohKeys.configs()
+	if len(configs.Configs) != len(supportedCipherSuites()) {
+		t.Fatalf("Expected %d configs, got %d", len(supportedCipherSuites()), len(configs.Configs))
+	}
+	parsedConfigs, err := odoh.UnmarshalObliviousDoHConfigs(configs.Marshal())
+	if err != nil || len(parsedConfigs.Configs) != len(configs.Configs) {
+		t.Fatal("Mixed-suite configs do not round trip")
+	}
+
+	q := r.queries[0]
+	for _, config := range parsedConfigs.Configs {
+		suite := cipherSuiteOf(config.Contents)
+		obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
+		encryptedQuery, context, err := config.Contents.EncryptQuery(obliviousQuery)
+		if err != nil {
+			t.Fatalf("%v: %v", suite, err)
+		}
+
+		request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(encryptedQuery.Marshal()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Add("Content-Type", odohMessageContentType)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		if status := rr.Result().StatusCode; status != http.StatusOK {
+			t.Fatalf("%v: result did not yield %d, got %d instead", suite, http.StatusOK, status)
+		}
+
+		responseBody, err := ioutil.ReadAll(rr.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		odohQueryResponse, err := odoh.UnmarshalDNSMessage(responseBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := context.OpenAnswer(odohQueryResponse)
+		if err != nil {
+			t.Fatalf("%v: %v", suite, err)
+		}
+		if !bytes.Equal(response, r.queryResponseMap[q]) {
+			t.Fatalf("%v: incorrect response received", suite)
+		}
+	}
+}
+
+func TestQueryHandlerODoHWithTruncatedEncapsulation(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+
+	config := target.odohKeys.configs().Configs[0]
+	message := odoh.CreateObliviousDNSMessage(odoh.QueryType, config.Contents.KeyID(), []byte{0x01, 0x02})
+
+	request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(message.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", odohMessageContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.targetQueryHandler).ServeHTTP(rr, request)
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusBadRequest, status)
+	}
+}
@@ -0,0 +1,95 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// SvcParamKey of the odohconfig parameter. The ODoH draft leaves it to be
+	// assigned, and this is the value existing ODoH clients look for.
+	odohConfigSvcParamKey dns.SVCBKey = 32769
+
+	// Kept short so that resolvers pick up rotated keys quickly.
+	serviceRecordTTL = 300
+)
+
+// serviceRecord synthesizes the HTTPS record advertising the target under
+// name, with an odohconfig parameter carrying the currently active configs.
+func (s *targetServer) serviceRecord(name string) (dns.RR, error) {
+	configs, err := s.keys().publicConfigs()
+	if err != nil {
+		return nil, err
+	}
+	return &dns.HTTPS{
+		SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeHTTPS,
+				Class:  dns.ClassINET,
+				Ttl:    serviceRecordTTL,
+			},
+			Priority: 1,
+			Target:   ".",
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{"h2"}},
+				&dns.SVCBLocal{KeyCode: odohConfigSvcParamKey, Data: configs.Marshal()},
+			},
+		},
+	}, nil
+}
+
+// serviceRecordResponse answers HTTPS queries for the target's own service
+// name locally. It returns nil for any other query, which should be resolved
+// upstream as usual. If the configs cannot be fetched, the answer is SERVFAIL.
+func (s *targetServer) serviceRecordResponse(query *dns.Msg) *dns.Msg {
+	if s.serviceName == "" || len(query.Question) != 1 {
+		return nil
+	}
+	question := query.Question[0]
+	if question.Qtype != dns.TypeHTTPS || question.Qclass != dns.ClassINET {
+		return nil
+	}
+	if !strings.EqualFold(dns.Fqdn(question.Name), dns.Fqdn(s.serviceName)) {
+		return nil
+	}
+
+	response := new(dns.Msg)
+	record, err := s.serviceRecord(question.Name)
+	if err != nil {
+		log.Println("Failed fetching ODoH configs:", err)
+		response.SetRcode(query, dns.RcodeServerFailure)
+		return response
+	}
+	response.SetReply(query)
+	response.Authoritative = true
+	response.Answer = []dns.RR{record}
+	if opt := query.IsEdns0(); opt != nil {
+		response.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+	return response
+}
@@ -0,0 +1,89 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func odohConfigFromResponse(t *testing.T, response *dns.Msg) []byte {
+	if len(response.Answer) != 1 {
+		t.Fatalf("Expected a single answer, got %v", response.Answer)
+	}
+	record, ok := response.Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatalf("Answer is not an HTTPS record: %v", response.Answer[0])
+	}
+	for _, value := range record.Value {
+		if value.Key() == odohConfigSvcParamKey {
+			return value.(*dns.SVCBLocal).Data
+		}
+	}
+	t.Fatal("HTTPS record has no odohconfig parameter")
+	return nil
+}
+
+func TestServiceRecordResponder(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	target.serviceName = "odoh.example.net"
+
+	q := new(dns.Msg)
+	q.SetQuestion("ODOH.example.net.", dns.TypeHTTPS)
+	packedQuery, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, response := sendDoHQuery(t, &target, packedQuery)
+	if response.Id != q.Id || response.Rcode != dns.RcodeSuccess || !response.Authoritative {
+		t.Fatalf("Unexpected response header: %v", response)
+	}
+	if !bytes.Equal(odohConfigFromResponse(t, response), target.odohKeys.configs().Marshal()) {
+		t.Fatal("odohconfig does not match the advertised configs")
+	}
+
+	rotator := &keyRotator{
+		keys:        target.odohKeys,
+		interval:    time.Hour,
+		gracePeriod: time.Hour,
+		generate:    cipherSuite.generateKeyPair,
+	}
+	if err := rotator.rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	_, response = sendDoHQuery(t, &target, packedQuery)
+	if !bytes.Equal(odohConfigFromResponse(t, response), target.odohKeys.configs().Marshal()) {
+		t.Fatal("odohconfig was not updated after rotation")
+	}
+
+	// Other names and types are still resolved upstream.
+	_, response = sendDoHQuery(t, &target, []byte(r.queries[0]))
+	if len(response.Answer) != 1 || response.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Fatalf("Upstream query was answered locally: %v", response)
+	}
+}
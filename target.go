@@ -24,10 +24,12 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"mime"
 	"net/http"
 	"time"
 
@@ -37,8 +39,16 @@ import (
 
 type targetServer struct {
 	verbose            bool
-	resolver           []resolver
-	odohKeyPair        odoh.ObliviousDoHKeyPair
+	upstreams          *upstreamSelector
+	cache              *answerCache
+	coalescer          *queryCoalescer
+	odohKeys           *targetKeySet
+	keyProvider        keyProvider
+	replayGuard        *replayGuard
+	responsePadding    paddingPolicy
+	dohPadding         paddingPolicy
+	dohPadAll          bool
+	serviceName        string
 	telemetryClient    *telemetry
 	serverInstanceName string
 	experimentId       string
@@ -55,38 +65,58 @@ func decodeDNSQuestion(encodedMessage []byte) (*dns.Msg, error) {
 	return msg, err
 }
 
+// The DNS wire format over HTTP (RFC 8484) is shared by the DoH endpoint of the
+// target and the DoH upstream resolver.
+
+// encodeDNSParameter encodes a packed message as the dns parameter of a GET
+// request.
+func encodeDNSParameter(packedMessage []byte) string {
+	return base64.RawURLEncoding.EncodeToString(packedMessage)
+}
+
+func decodeDNSParameter(parameter string) (*dns.Msg, error) {
+	if parameter == "" {
+		return nil, fmt.Errorf("Missing DNS query parameter in GET request")
+	}
+
+	encodedMessage, err := base64.RawURLEncoding.DecodeString(parameter)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeDNSQuestion(encodedMessage)
+}
+
+// readDNSMessage decodes the message in an HTTP body of the given content type.
+// Parameters of the content type, such as a charset, are ignored.
+func readDNSMessage(body io.Reader, contentType string) (*dns.Msg, error) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != dnsMessageContentType {
+		return nil, fmt.Errorf("incorrect content type, expected '%s', got %s", dnsMessageContentType, contentType)
+	}
+
+	encodedMessage, err := ioutil.ReadAll(io.LimitReader(body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeDNSQuestion(encodedMessage)
+}
+
 func (s *targetServer) parseQueryFromRequest(r *http.Request) (*dns.Msg, error) {
 	switch r.Method {
 	case http.MethodGet:
-		var queryBody string
-		if queryBody = r.URL.Query().Get("dns"); queryBody == "" {
-			return nil, fmt.Errorf("Missing DNS query parameter in GET request")
-		}
-
-		encodedMessage, err := base64.RawURLEncoding.DecodeString(queryBody)
-		if err != nil {
-			return nil, err
-		}
-
-		return decodeDNSQuestion(encodedMessage)
+		return decodeDNSParameter(r.URL.Query().Get("dns"))
 	case http.MethodPost:
-		if r.Header.Get("Content-Type") != dnsMessageContentType {
-			return nil, fmt.Errorf("incorrect content type, expected '%s', got %s", dnsMessageContentType, r.Header.Get("Content-Type"))
-		}
-
 		defer r.Body.Close()
-		encodedMessage, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		return decodeDNSQuestion(encodedMessage)
+		return readDNSMessage(r.Body, r.Header.Get("Content-Type"))
 	default:
 		return nil, fmt.Errorf("unsupported HTTP method")
 	}
 }
 
-func (s *targetServer) resolveQueryWithResolver(q *dns.Msg, r resolver) ([]byte, error) {
+// resolveQuery answers q, locally, from the cache or through the upstreams,
+// and records in exp the upstreams tried and the one that answered.
+func (s *targetServer) resolveQuery(q *dns.Msg, exp *experiment) ([]byte, error) {
 	packedQuery, err := q.Pack()
 	if err != nil {
 		log.Println("Failed encoding DNS query:", err)
@@ -98,7 +128,17 @@ func (s *targetServer) resolveQueryWithResolver(q *dns.Msg, r resolver) ([]byte,
 	}
 
 	start := time.Now()
-	response, err := r.resolve(q)
+	response := s.serviceRecordResponse(q)
+	if response == nil && s.cache != nil {
+		response = s.cache.get(q, start)
+		exp.CacheHit = response != nil
+	}
+	if response == nil {
+		response, err = s.resolveUpstream(q, exp)
+		if err != nil {
+			return nil, err
+		}
+	}
 	elapsed := time.Since(start)
 
 	packedResponse, err := response.Pack()
@@ -132,11 +172,12 @@ func (s *targetServer) dohQueryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	timestamp.TargetQueryDecryptionTime = time.Now().UnixNano()
 
-	availableResolvers := len(s.resolver)
-	chosenResolver := rand.Intn(availableResolvers)
-	packedResponse, err := s.resolveQueryWithResolver(query, s.resolver[chosenResolver])
+	packedResponse, err := s.resolveQuery(query, &exp)
 	if err != nil {
 		log.Println("Failed resolving DNS query:", err)
+		exp.Timestamp = timestamp
+		exp.Status = false
+		s.telemetryClient.stream([]string{exp.serialize()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -145,20 +186,32 @@ func (s *targetServer) dohQueryHandler(w http.ResponseWriter, r *http.Request) {
 	timestamp.TargetAnswerEncryptionTime = endTime
 	timestamp.EndTime = endTime
 
+	if s.dohPadding.mode != paddingNone && (s.dohPadAll || hasPaddingOption(query)) {
+		packedResponse, err = s.padResponse(packedResponse)
+		if err != nil {
+			log.Println("Failed padding DNS response:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	exp.Timestamp = timestamp
-	exp.Resolver = s.resolver[chosenResolver].name()
 	exp.Status = true
 
-	if s.telemetryClient.logClient != nil {
-		go s.telemetryClient.streamTelemetryToGCPLogging([]string{exp.serialize()})
-	} else if s.telemetryClient.esClient != nil {
-		go s.telemetryClient.streamDataToElastic([]string{exp.serialize()})
-	}
+	s.telemetryClient.stream([]string{exp.serialize()})
 
 	w.Header().Set("Content-Type", dnsMessageContentType)
 	w.Write(packedResponse)
 }
 
+func (s *targetServer) padResponse(packedResponse []byte) ([]byte, error) {
+	response := &dns.Msg{}
+	if err := response.Unpack(packedResponse); err != nil {
+		return nil, err
+	}
+	return padDNSMessage(response, s.dohPadding)
+}
+
 func (s *targetServer) parseObliviousQueryFromRequest(r *http.Request) (odoh.ObliviousDNSMessage, error) {
 	if r.Method != http.MethodPost {
 		return odoh.ObliviousDNSMessage{}, fmt.Errorf("Unsupported HTTP method for Oblivious DNS query: %s", r.Method)
@@ -173,8 +226,18 @@ func (s *targetServer) parseObliviousQueryFromRequest(r *http.Request) (odoh.Obl
 	return odoh.UnmarshalDNSMessage(encryptedMessageBytes)
 }
 
-func (s *targetServer) createObliviousResponseForQuery(context odoh.ResponseContext, dnsResponse []byte) (odoh.ObliviousDNSMessage, error) {
-	response := odoh.CreateObliviousDNSResponse(dnsResponse, 0)
+// keys returns the provider that decrypts queries, which defaults to the
+// target's own keys.
+func (s *targetServer) keys() keyProvider {
+	if s.keyProvider != nil {
+		return s.keyProvider
+	}
+	return s.odohKeys
+}
+
+func (s *targetServer) createObliviousResponseForQuery(context responseEncrypter, dnsResponse []byte) (odoh.ObliviousDNSMessage, error) {
+	paddingLength := s.responsePadding.paddingLength(len(dnsResponse))
+	response := odoh.CreateObliviousDNSResponse(dnsResponse, uint16(paddingLength))
 	odohResponse, err := context.EncryptResponse(response)
 
 	if s.verbose {
@@ -200,11 +263,25 @@ func (s *targetServer) odohQueryHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	obliviousQuery, responseContext, err := s.odohKeyPair.DecryptQuery(odohMessage)
-	if err != nil {
-		log.Println("DecryptQuery failed:", err)
+	obliviousQuery, responseContext, err := s.keys().decryptQuery(odohMessage)
+	if errors.Is(err, errUnknownKey) {
+		log.Printf("Unknown key ID: %x", odohMessage.KeyID)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, errInvalidQuery) {
+		log.Println("decryptQuery failed:", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
+	} else if err != nil {
+		log.Println("Key provider failed:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if s.replayGuard != nil && s.replayGuard.seen(odohMessage, time.Now()) {
+		log.Printf("Rejected replayed query for key ID: %x", odohMessage.KeyID)
+		http.Error(w, http.StatusText(http.StatusTooEarly), http.StatusTooEarly)
+		return
 	}
 
 	query, err := decodeDNSQuestion(obliviousQuery.Message())
@@ -217,10 +294,12 @@ func (s *targetServer) odohQueryHandler(w http.ResponseWriter, r *http.Request)
 	queryParseAndDecryptionCompleteTime := time.Now().UnixNano()
 	timestamp.TargetQueryDecryptionTime = queryParseAndDecryptionCompleteTime
 
-	chosenResolver := rand.Intn(len(s.resolver))
-	packedResponse, err := s.resolveQueryWithResolver(query, s.resolver[chosenResolver])
+	packedResponse, err := s.resolveQuery(query, &exp)
 	if err != nil {
-		log.Println("resolveQueryWithResolver failed:", err)
+		log.Println("resolveQuery failed:", err)
+		exp.Timestamp = timestamp
+		exp.Status = false
+		s.telemetryClient.stream([]string{exp.serialize()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -236,11 +315,7 @@ func (s *targetServer) odohQueryHandler(w http.ResponseWriter, r *http.Request)
 		exp.Timestamp = timestamp
 		exp.Status = false
 		exp.Resolver = ""
-		if s.telemetryClient.logClient != nil {
-			go s.telemetryClient.streamTelemetryToGCPLogging([]string{exp.serialize()})
-		} else if s.telemetryClient.esClient != nil {
-			go s.telemetryClient.streamDataToElastic([]string{exp.serialize()})
-		}
+		s.telemetryClient.stream([]string{exp.serialize()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -257,14 +332,9 @@ func (s *targetServer) odohQueryHandler(w http.ResponseWriter, r *http.Request)
 	timestamp.EndTime = returnResponseTime
 
 	exp.Timestamp = timestamp
-	exp.Resolver = s.resolver[chosenResolver].name()
 	exp.Status = true
 
-	if s.telemetryClient.logClient != nil {
-		go s.telemetryClient.streamTelemetryToGCPLogging([]string{exp.serialize()})
-	} else if s.telemetryClient.esClient != nil {
-		go s.telemetryClient.streamDataToElastic([]string{exp.serialize()})
-	}
+	s.telemetryClient.stream([]string{exp.serialize()})
 
 	w.Header().Set("Content-Type", odohMessageContentType)
 	w.Write(packedResponseMessage)
@@ -288,7 +358,11 @@ func (s *targetServer) targetQueryHandler(w http.ResponseWriter, r *http.Request
 func (s *targetServer) configHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
 
-	configSet := []odoh.ObliviousDoHConfig{s.odohKeyPair.Config}
-	configs := odoh.CreateObliviousDoHConfigs(configSet)
+	configs, err := s.keys().publicConfigs()
+	if err != nil {
+		log.Println("Failed fetching ODoH configs:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	w.Write(configs.Marshal())
 }
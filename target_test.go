@@ -24,6 +24,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
@@ -47,7 +48,7 @@ func (r localResolver) name() string {
 	return "localResolver"
 }
 
-func (r localResolver) resolve(query *dns.Msg) (*dns.Msg, error) {
+func (r localResolver) resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
 	packedQuery, err := query.Pack()
 	if err != nil {
 		return nil, err
@@ -105,7 +106,7 @@ func createKeyPair(t *testing.T) odoh.ObliviousDoHKeyPair {
 	seed := make([]byte, defaultSeedLength)
 	rand.Read(seed)
 
-	keyPair, err := odoh.CreateKeyPairFromSeed(kemID, kdfID, aeadID, seed)
+	keyPair, err := defaultCipherSuite.keyPairFromSeed(seed)
 	if err != nil {
 		t.Fatal("Failed to create a private key. Exiting now.")
 	}
@@ -115,8 +116,8 @@ func createKeyPair(t *testing.T) odoh.ObliviousDoHKeyPair {
 
 func createTarget(t *testing.T, r resolver) targetServer {
 	return targetServer{
-		resolver:        []resolver{r},
-		odohKeyPair:     createKeyPair(t),
+		upstreams:       newUpstreamSelector([]upstream{{resolver: r, label: r.name(), weight: 1}}, strategyWeightedRandom),
+		odohKeys:        newTargetKeySet(createKeyPair(t)),
 		telemetryClient: getTelemetryInstance("LOG"),
 	}
 }
@@ -125,8 +126,12 @@ func TestConfigHandler(t *testing.T) {
 	r := createLocalResolver(t)
 	target := createTarget(t, r)
 
-	configSet := []odoh.ObliviousDoHConfig{target.odohKeyPair.Config}
-	configs := odoh.CreateObliviousDoHConfigs(configSet)
+	target.odohKeys.add(createKeyPair(t))
+
+	configs := target.odohKeys.configs()
+	if len(configs.Configs) != 2 {
+		t.Fatalf("Expected 2 configs, got %d", len(configs.Configs))
+	}
 	marshalledConfig := configs.Marshal()
 
 	handler := http.HandlerFunc(target.configHandler)
@@ -268,7 +273,7 @@ func TestQueryHandlerODoHWithInvalidMethod(t *testing.T) {
 
 	q := r.queries[0]
 	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
-	encryptedQuery, _, err := target.odohKeyPair.Config.Contents.EncryptQuery(obliviousQuery)
+	encryptedQuery, _, err := target.odohKeys.configs().Configs[0].Contents.EncryptQuery(obliviousQuery)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -295,7 +300,7 @@ func TestQueryHandlerODoH(t *testing.T) {
 
 	q := r.queries[0]
 	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
-	encryptedQuery, context, err := target.odohKeyPair.Config.Contents.EncryptQuery(obliviousQuery)
+	encryptedQuery, context, err := target.odohKeys.configs().Configs[0].Contents.EncryptQuery(obliviousQuery)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -359,8 +364,58 @@ func TestQueryHandlerODoHWithInvalidKey(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, request)
 
-	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
-		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	if status := rr.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusUnauthorized, status))
+	}
+}
+
+func TestQueryHandlerODoHWithMultipleKeys(t *testing.T) {
+	r := createLocalResolver(t)
+	target := createTarget(t, r)
+	secondKeyPair := createKeyPair(t)
+	target.odohKeys.add(secondKeyPair)
+
+	handler := http.HandlerFunc(target.targetQueryHandler)
+
+	q := r.queries[0]
+	for _, config := range target.odohKeys.configs().Configs {
+		obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
+		encryptedQuery, context, err := config.Contents.EncryptQuery(obliviousQuery)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, err := http.NewRequest(http.MethodPost, queryEndpoint, bytes.NewReader(encryptedQuery.Marshal()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Add("Content-Type", odohMessageContentType)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		if status := rr.Result().StatusCode; status != http.StatusOK {
+			t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+		}
+
+		responseBody, err := ioutil.ReadAll(rr.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		odohQueryResponse, err := odoh.UnmarshalDNSMessage(responseBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := context.OpenAnswer(odohQueryResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(response, r.queryResponseMap[q]) {
+			t.Fatal(fmt.Errorf("Incorrect response received. Got %v, expected %v", response, r.queryResponseMap[q]))
+		}
 	}
 }
 
@@ -372,7 +427,7 @@ func TestQueryHandlerODoHWithCorruptCiphertext(t *testing.T) {
 
 	q := r.queries[0]
 	obliviousQuery := odoh.CreateObliviousDNSQuery([]byte(q), 0)
-	encryptedQuery, _, err := target.odohKeyPair.Config.Contents.EncryptQuery(obliviousQuery)
+	encryptedQuery, _, err := target.odohKeys.configs().Configs[0].Contents.EncryptQuery(obliviousQuery)
 	if err != nil {
 		t.Fatal(err)
 	}
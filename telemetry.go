@@ -32,6 +32,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 // This runningTime structure contains the epoch timestamps for the following operations
@@ -48,6 +49,10 @@ type runningTime struct {
 type experiment struct {
 	RequestID    []byte
 	Resolver     string
+	Attempts     []upstreamAttempt
+	CacheHit     bool
+	StaleAnswer  bool
+	Coalesced    bool
 	Timestamp    runningTime
 	Status       bool
 	IngestedFrom string
@@ -64,6 +69,139 @@ func (e *experiment) serialize() string {
 	return string(response)
 }
 
+// upstreamAttempt records one upstream tried for a query, with the response
+// code it answered or the error it failed with, and how long it took in
+// nanoseconds. Hedged attempts were sent while an earlier one was still
+// pending; the experiment's Resolver names the upstream whose answer won.
+type upstreamAttempt struct {
+	Upstream string
+	Rcode    string
+	Error    string
+	Duration int64
+	Hedged   bool
+}
+
+// keyEvent records a change to the set of ODoH keys held by a target, such as
+// a key being generated during rotation or a retiring key being dropped.
+type keyEvent struct {
+	Event        string
+	KeyID        string
+	State        string
+	Timestamp    int64
+	IngestedFrom string
+	ExperimentID string
+}
+
+func (e *keyEvent) serialize() string {
+	response, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to log the information correctly.")
+	}
+	return string(response)
+}
+
+// auditEvent records an action taken through the admin API.
+type auditEvent struct {
+	Action       string
+	KeyID        string
+	Actor        string
+	RemoteAddr   string
+	Outcome      string
+	Timestamp    int64
+	IngestedFrom string
+	ExperimentID string
+}
+
+func (e *auditEvent) serialize() string {
+	response, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to log the information correctly.")
+	}
+	return string(response)
+}
+
+// replayEvent counts the replayed ODoH queries rejected during a replay
+// window, along with the total since the target started.
+type replayEvent struct {
+	Event         string
+	WindowStart   int64
+	Rejected      int
+	TotalRejected int
+	Timestamp     int64
+	IngestedFrom  string
+	ExperimentID  string
+}
+
+func (e *replayEvent) serialize() string {
+	response, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to log the information correctly.")
+	}
+	return string(response)
+}
+
+// cacheEvent reports the answer cache counters since the target started, and
+// the number of entries it holds. Prefetches are resolutions started by the
+// cache rather than by clients; limited ones were skipped by the rate limit.
+type cacheEvent struct {
+	Event             string
+	Hits              uint64
+	Misses            uint64
+	StaleHits         uint64
+	Evictions         uint64
+	Prefetches        uint64
+	PrefetchFailures  uint64
+	PrefetchesLimited uint64
+	Entries           int
+	Timestamp         int64
+	IngestedFrom      string
+	ExperimentID      string
+}
+
+func (e *cacheEvent) serialize() string {
+	response, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to log the information correctly.")
+	}
+	return string(response)
+}
+
+// coalesceEvent reports how many upstream exchanges the target made since it
+// started, and how many queries shared one instead of making their own.
+type coalesceEvent struct {
+	Event        string
+	Exchanges    uint64
+	Coalesced    uint64
+	Timestamp    int64
+	IngestedFrom string
+	ExperimentID string
+}
+
+func (e *coalesceEvent) serialize() string {
+	response, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to log the information correctly.")
+	}
+	return string(response)
+}
+
+// Interval at which counters are sent to telemetry
+const counterReportInterval = time.Minute
+
+// reportEvery calls report every interval until stop is closed.
+func reportEvery(interval time.Duration, stop <-chan struct{}, report func(now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			report(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
 type telemetry struct {
 	sync.RWMutex
 	esClient    *elasticsearch.Client
@@ -110,6 +248,16 @@ func getTelemetryInstance(telemetryType string) *telemetry {
 	return &telemetryInstance
 }
 
+// stream asynchronously sends dataItems to whichever telemetry backend is
+// configured. It is a no-op when telemetry only goes to the local log.
+func (t *telemetry) stream(dataItems []string) {
+	if t.logClient != nil {
+		go t.streamTelemetryToGCPLogging(dataItems)
+	} else if t.esClient != nil {
+		go t.streamDataToElastic(dataItems)
+	}
+}
+
 func (t *telemetry) streamTelemetryToGCPLogging(dataItems []string) {
 	defer t.cloudlogger.Flush()
 	for _, item := range dataItems {
@@ -0,0 +1,192 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUpstreams       = "tcp://1.1.1.1:53,tcp://8.8.8.8:53,tcp://9.9.9.9:53"
+	defaultUpstreamTimeout = 2500 * time.Millisecond
+	defaultDNSPort         = "53"
+)
+
+// upstreamConfig is an upstream declared as a URL, e.g.
+// tcp://10.0.0.2:53?timeout=1s&weight=2&name=primary. Options other than
+// timeout, weight and name are left to the transport.
+type upstreamConfig struct {
+	url     *url.URL
+	name    string
+	timeout time.Duration
+	weight  int
+	options url.Values
+}
+
+// address returns the host and port of the upstream, with the given port when
+// the URL has none.
+func (c upstreamConfig) address(defaultPort string) string {
+	if c.url.Port() == "" {
+		return net.JoinHostPort(c.url.Hostname(), defaultPort)
+	}
+	return c.url.Host
+}
+
+// checkOptions fails if the upstream carries options other than allowed.
+func (c upstreamConfig) checkOptions(allowed ...string) error {
+	for option := range c.options {
+		known := false
+		for _, name := range allowed {
+			known = known || option == name
+		}
+		if !known {
+			return fmt.Errorf("upstream %s: unsupported option %q", c.name, option)
+		}
+	}
+	return nil
+}
+
+// resolverSchemes builds the resolver of an upstream from its URL scheme.
+var resolverSchemes = map[string]func(config upstreamConfig) (resolver, error){
+	"tcp":       newTCPResolver,
+	"udp":       newUDPResolver,
+	"tls":       newTLSResolver,
+	"https":     newDoHResolver,
+	"recursive": newRecursiveResolver,
+}
+
+// upstream is a resolver as configured, along with the name it is reported
+// under and its share of the queries.
+type upstream struct {
+	resolver
+	label  string
+	weight int
+}
+
+func (u upstream) name() string {
+	return u.label
+}
+
+func parseUpstreamConfig(rawURL string) (upstreamConfig, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return upstreamConfig{}, err
+	}
+	name := parsed.Host
+	if parsed.Scheme == "recursive" {
+		// The recursive resolver finds the servers to query itself.
+		name = parsed.Scheme
+	} else if parsed.Host == "" {
+		return upstreamConfig{}, fmt.Errorf("upstream %q has no host", rawURL)
+	}
+
+	options := parsed.Query()
+	config := upstreamConfig{
+		url:     parsed,
+		name:    name,
+		timeout: defaultUpstreamTimeout,
+		weight:  1,
+		options: options,
+	}
+	if name := options.Get("name"); name != "" {
+		config.name = name
+	}
+	if timeout := options.Get("timeout"); timeout != "" {
+		if config.timeout, err = time.ParseDuration(timeout); err != nil || config.timeout <= 0 {
+			return upstreamConfig{}, fmt.Errorf("upstream %s: invalid timeout %q", config.name, timeout)
+		}
+	}
+	if weight := options.Get("weight"); weight != "" {
+		if config.weight, err = strconv.Atoi(weight); err != nil || config.weight <= 0 {
+			return upstreamConfig{}, fmt.Errorf("upstream %s: invalid weight %q", config.name, weight)
+		}
+	}
+	options.Del("name")
+	options.Del("timeout")
+	options.Del("weight")
+	return config, nil
+}
+
+// newUpstream builds the resolver of an upstream URL through resolverSchemes.
+func newUpstream(rawURL string) (upstream, error) {
+	config, err := parseUpstreamConfig(rawURL)
+	if err != nil {
+		return upstream{}, err
+	}
+	newResolver, ok := resolverSchemes[config.url.Scheme]
+	if !ok {
+		return upstream{}, fmt.Errorf("upstream %s: unsupported scheme %q", config.name, config.url.Scheme)
+	}
+	r, err := newResolver(config)
+	if err != nil {
+		return upstream{}, err
+	}
+	return upstream{resolver: r, label: config.name, weight: config.weight}, nil
+}
+
+// parseUpstreams builds upstreams from URLs separated by commas or
+// whitespace.
+func parseUpstreams(setting string) ([]upstream, error) {
+	upstreams := make([]upstream, 0)
+	for _, rawURL := range strings.FieldsFunc(setting, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		u, err := newUpstream(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream configured")
+	}
+	return upstreams, nil
+}
+
+// loadUpstreams reads upstream URLs from a file, one per line. Blank lines and
+// lines starting with # are ignored.
+func loadUpstreams(path string) ([]upstream, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseUpstreams(strings.Join(lines, ","))
+}
@@ -0,0 +1,94 @@
+// The MIT License
+//
+// Copyright (c) 2019-2020, Cloudflare, Inc. and Apple, Inc. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := parseUpstreams("tcp://10.0.0.2?timeout=1s&weight=3&name=primary, tcp://[2001:db8::1]:5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 2 {
+		t.Fatalf("Expected 2 upstreams, got %d", len(upstreams))
+	}
+
+	primary := upstreams[0]
+	if primary.name() != "primary" || primary.weight != 3 {
+		t.Fatalf("Unexpected upstream %s with weight %d", primary.name(), primary.weight)
+	}
+	if r := primary.resolver.(targetResolver); r.nameserver != "10.0.0.2:53" || r.timeout != time.Second {
+		t.Fatalf("Unexpected resolver %s with timeout %v", r.nameserver, r.timeout)
+	}
+
+	secondary := upstreams[1]
+	if secondary.name() != "[2001:db8::1]:5353" || secondary.weight != 1 {
+		t.Fatalf("Unexpected upstream %s with weight %d", secondary.name(), secondary.weight)
+	}
+	if r := secondary.resolver.(targetResolver); r.timeout != defaultUpstreamTimeout {
+		t.Fatalf("Unexpected default timeout %v", r.timeout)
+	}
+}
+
+func TestParseUpstreamsInvalid(t *testing.T) {
+	for _, setting := range []string{
+		"",
+		"gopher://10.0.0.2",
+		"tcp://10.0.0.2?weight=0",
+		"tcp://10.0.0.2?timeout=soon",
+		"tcp://10.0.0.2?unknown=1",
+		"10.0.0.2:53",
+	} {
+		if _, err := parseUpstreams(setting); err == nil {
+			t.Fatalf("Upstreams %q should be rejected", setting)
+		}
+	}
+}
+
+func TestLoadUpstreams(t *testing.T) {
+	directory, err := ioutil.TempDir("", "odoh-upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "upstreams")
+	contents := "# Resolvers of the local site\ntcp://10.0.0.2:53\n\ntcp://10.0.0.3:53?name=backup\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams, err := loadUpstreams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 2 || upstreams[1].name() != "backup" {
+		t.Fatalf("Unexpected upstreams %v", upstreams)
+	}
+}